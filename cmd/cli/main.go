@@ -1,19 +1,47 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"echo-cicd/configs"
 	"echo-cicd/internal"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/alecthomas/kong"
 	docker "github.com/docker/docker/client"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Agent struct {
-	DockerHost   string            `help:"The docker host, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
-	RegistryAuth map[string]string `help:"Authentication strings to use when authenticating against various registries"`
+	DockerHost        string `help:"The docker host, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
+	DockerConfig      string `help:"The docker config.json to read registry credentials from, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json" type:"path"`
+	AgentId           string `help:"The name this agent reports its deployments under, defaults to the hostname"`
+	CaddyAdmin        string `help:"The url of a Caddy admin API to manage the routes of each project's domain through, ie http://localhost:2019"`
+	CaddyServer       string `help:"The Caddy http server to add routes to, created if it doesn't exist" default:"echocicd"`
+	CaddyListen       string `help:"The address the Caddy server listens on if it has to be created" default:":443"`
+	CaddyUpstreamHost string `help:"The host Caddy reaches published container ports on" default:"127.0.0.1"`
+}
+
+// loadRegistryAuths prefers an explicit pre-encoded auth string, falling back to the docker config.json
+func loadRegistryAuths(override *string, dockerConfig string) (*internal.RegistryAuths, error) {
+	if dockerConfig == "" {
+		dockerConfig = internal.DefaultDockerConfigPath()
+	}
+
+	config, err := internal.LoadDockerConfig(dockerConfig)
+	if err != nil {
+		slog.Error("could not load the docker config", "path", dockerConfig, "err", err)
+		return nil, err
+	}
+
+	return &internal.RegistryAuths{Override: override, Config: config}, nil
 }
 
 func (a Agent) Run() error {
@@ -23,17 +51,51 @@ func (a Agent) Run() error {
 		slog.Error("could not connect to etcd server", "err", err)
 		return err
 	}
-	internal.LaunchAgent(etcd, conn, a.RegistryAuth)
+	agentId := a.AgentId
+	if agentId == "" {
+		agentId, err = os.Hostname()
+		if err != nil {
+			slog.Error("could not determine the hostname, specify an agent id", "err", err)
+			return err
+		}
+	}
+
+	auths, err := loadRegistryAuths(nil, a.DockerConfig)
+	if err != nil {
+		return err
+	}
+
+	var caddy *internal.CaddyClient
+	if a.CaddyAdmin != "" {
+		caddy = &internal.CaddyClient{
+			AdminUrl:     a.CaddyAdmin,
+			Server:       a.CaddyServer,
+			Listen:       a.CaddyListen,
+			UpstreamHost: a.CaddyUpstreamHost,
+		}
+		err = caddy.EnsureServer(context.Background())
+		if err != nil {
+			slog.Error("could not prepare the caddy server", "err", err)
+			return err
+		}
+	}
+
+	internal.LaunchAgent(etcd, conn, auths, agentId, caddy)
 	return nil
 }
 
 type Webhook struct {
-	PushAuth        *string `help:"The authentication to pass to the push command if required"`
-	Registry        *string `help:"The registry to which this image will be pushed if relevant"`
-	DockerHost      string  `help:"The docker host, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
-	BuilderDir      string  `help:"The folder in which to look for builders, defaults to /builders" default:"/builders"`
-	BindAddress     string  `help:"The address and port on which the server should bind" default:"0.0.0.0:15342"`
-	AllowedRefsFile []byte  `help:"The file containing the JSON list of allowed refs" type:"filecontent"`
+	PushAuth        *string       `help:"The encoded authentication to pass to the push command, overrides the docker config" env:"PUSH_AUTH"`
+	DockerConfig    string        `help:"The docker config.json to read registry credentials from, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json" type:"path"`
+	Registry        *string       `help:"The registry to which this image will be pushed if relevant"`
+	DockerHost      string        `help:"The docker host, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
+	BuilderDir      string        `help:"The folder in which to look for builders, defaults to /builders" default:"/builders"`
+	BindAddress     string        `help:"The address and port on which the server should bind" default:"0.0.0.0:15342"`
+	AllowedRefsFile []byte        `help:"The file containing the JSON list of allowed refs" type:"filecontent"`
+	GitBaseUrl      *string       `help:"The base url of the git server used to clone manually triggered builds, ie http://gitea:3000"`
+	BuilderRepo     string        `help:"A git url to fetch builders from, the builder dir is then used to cache them"`
+	BuilderRef      string        `help:"The branch, tag or commit of the builder repo to use, defaults to its default branch"`
+	BuilderRefresh  time.Duration `help:"How often to fetch the builder repo, pushes to it also trigger a fetch" default:"5m"`
 }
 
 func (w Webhook) Run() error {
@@ -56,13 +118,30 @@ func (w Webhook) Run() error {
 		return err
 	}
 
+	auths, err := loadRegistryAuths(w.PushAuth, w.DockerConfig)
+	if err != nil {
+		return err
+	}
+
+	var builders *internal.BuilderRepository
+	if w.BuilderRepo != "" {
+		builders, err = internal.NewBuilderRepository(context.Background(), w.BuilderRepo, w.BuilderRef, w.BuilderDir)
+		if err != nil {
+			slog.Error("could not fetch the builder repo", "url", w.BuilderRepo, "err", err)
+			return err
+		}
+		go builders.LaunchRefresher(context.Background(), w.BuilderRefresh)
+	}
+
 	config := internal.WebhookConfiguration{
 		BuildersDir: w.BuilderDir,
+		Builders:    builders,
 		Conn:        conn,
 		Registry:    w.Registry,
-		PushAuth:    w.PushAuth,
+		Auths:       auths,
 		Bind:        w.BindAddress,
 		Etcd:        etcd,
+		GitBaseUrl:  w.GitBaseUrl,
 	}
 
 	slog.Info("launching webhook server", "bind", w.BindAddress)
@@ -71,11 +150,13 @@ func (w Webhook) Run() error {
 }
 
 type Build struct {
-	PushAuth     *string `help:"The authentication to pass to the push command if required"`
+	PushAuth     *string `help:"The encoded authentication to pass to the push command, overrides the docker config" env:"PUSH_AUTH"`
+	DockerConfig string  `help:"The docker config.json to read registry credentials from, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json" type:"path"`
 	Registry     *string `help:"The registry to which this image will be pushed if relevant"`
 	DockerHost   string  `help:"The docker host, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
 	BuilderDir   string  `help:"The folder in which to look for builders, defaults to /builders" default:"/builders"`
 	DeployConfig string  `help:"The deploy config file to use, defaults to deploy-config.toml" default:"deploy-config.toml" type:"path"`
+	Env          string  `help:"The environment from the deploy config to build, defaults to the base config"`
 }
 
 func (receiver Build) Run() error {
@@ -90,18 +171,34 @@ func (receiver Build) Run() error {
 		if errors.Is(err, os.ErrNotExist) {
 			slog.Error("failed to process deploy config - file could not be found")
 		} else {
-			slog.Error("failed to process deploy config - error loading file: %w", err)
+			slog.Error("failed to process deploy config - error loading file", "err", err)
 		}
 		return err
 	}
 
+	if receiver.Env != "" {
+		config, err = config.ForEnvironment(receiver.Env)
+		if err != nil {
+			slog.Error("failed to process deploy config", "err", err)
+			return err
+		}
+	}
+
 	etcd, err := internal.NewClient(cli.EtcdEndpoints)
 	if err != nil {
 		slog.Error("could not connect to etcd server", "err", err)
 		return err
 	}
 
-	err = internal.BuildFromConfig(*config, cli.Build.BuilderDir, cli.WorkingDir, conn, receiver.Registry, receiver.PushAuth, etcd)
+	auths, err := loadRegistryAuths(receiver.PushAuth, receiver.DockerConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = internal.BuildFromConfig(ctx, *config, cli.Build.BuilderDir, cli.WorkingDir, conn, receiver.Registry, auths, etcd, os.Stdout)
 	if err != nil {
 		slog.Error("failed to build", "err", err)
 		return err
@@ -110,6 +207,556 @@ func (receiver Build) Run() error {
 	return nil
 }
 
+type Validate struct {
+	DeployConfig string `arg:"" optional:"" help:"The deploy config file to validate, defaults to .deploy-config.toml" default:".deploy-config.toml" type:"path"`
+	BuilderDir   string `help:"If set the builder the config uses is loaded from this folder and its args are validated too"`
+}
+
+func (v Validate) Run() error {
+	content, err := os.ReadFile(v.DeployConfig)
+	if err != nil {
+		slog.Error("could not read the deploy config", "path", v.DeployConfig, "err", err)
+		return err
+	}
+
+	config, err := configs.ValidateDeployConfig(string(content))
+	if err != nil {
+		var validationErr configs.ValidationError
+		if errors.As(err, &validationErr) {
+			for _, problem := range validationErr.Problems {
+				fmt.Printf("%v: %v\n", v.DeployConfig, problem)
+			}
+			return fmt.Errorf("found %v problems in %v", len(validationErr.Problems), v.DeployConfig)
+		}
+		return err
+	}
+
+	if v.BuilderDir != "" {
+		_, err = internal.ResolveBuildSource(*config, v.BuilderDir, filepath.Dir(v.DeployConfig))
+		if err != nil {
+			fmt.Printf("%v: %v\n", v.DeployConfig, err)
+			return err
+		}
+	}
+
+	fmt.Printf("%v is valid\n", v.DeployConfig)
+	return nil
+}
+
+type Init struct {
+	Name       string            `help:"The name of the deployment, defaults to the folder name"`
+	Repo       string            `help:"The full name of the repository, ie ryan/test-deploy, defaults to the origin remote"`
+	Builder    string            `help:"The builder to use, defaults to one suited to the project"`
+	Dockerfile string            `help:"Build from this Dockerfile in the repository instead of a builder"`
+	Arg        map[string]string `help:"Builder args, values are parsed as JSON where possible"`
+	Port       map[string]int    `help:"Ports to publish as container=host, ie 8080/tcp=80"`
+	Domain     string            `help:"The domain the deployment should be served on"`
+	DomainPort int               `help:"The port the domain should be routed to, defaults to the first host port"`
+	BuilderDir string            `help:"The folder in which to look for builders, defaults to /builders" default:"/builders"`
+	Yes        bool              `help:"Accept the detected defaults without prompting" short:"y"`
+	Force      bool              `help:"Overwrite an existing deploy config"`
+}
+
+func (i Init) Run() error {
+	target := filepath.Join(cli.WorkingDir, ".deploy-config.toml")
+	if _, err := os.Stat(target); err == nil && !i.Force {
+		return fmt.Errorf("%v already exists, use --force to overwrite it", target)
+	}
+
+	builders, err := internal.ListBuilders(i.BuilderDir)
+	if err != nil {
+		slog.Warn("could not list builders, no builder will be suggested and builder args will not be checked", "dir", i.BuilderDir, "err", err)
+	}
+	available := make([]string, 0, len(builders))
+	for _, builder := range builders {
+		available = append(available, builder.Manifest.Name)
+	}
+
+	options := internal.DetectProject(cli.WorkingDir, available)
+	stat, _ := os.Stdin.Stat()
+	prompter := prompter{
+		reader:      bufio.NewReader(os.Stdin),
+		interactive: !i.Yes && stat != nil && stat.Mode()&os.ModeCharDevice != 0,
+	}
+
+	options.Name = prompter.ask("Deployment name", firstNonEmpty(i.Name, options.Name))
+	options.Repo = prompter.ask("Repository (owner/name)", firstNonEmpty(i.Repo, options.Repo))
+	if options.Repo == "" {
+		return errors.New("the repository could not be found from the origin remote, pass it with --repo")
+	}
+
+	if i.Dockerfile != "" || (i.Builder == "" && options.Dockerfile != "") {
+		options.Dockerfile = prompter.ask("Dockerfile", firstNonEmpty(i.Dockerfile, options.Dockerfile))
+		options.Builder = ""
+	} else {
+		options.Dockerfile = ""
+		if prompter.interactive && len(builders) > 0 {
+			fmt.Println("Available builders:")
+			for _, builder := range builders {
+				fmt.Printf("  %v@%v\t%v\n", builder.Manifest.Name, builder.Manifest.Version, builder.Manifest.Description)
+			}
+		}
+		detected := options.Builder
+		options.Builder = prompter.ask("Builder", firstNonEmpty(i.Builder, options.Builder))
+		// Args guessed for the detected builder won't mean anything to a different one
+		if options.Builder != detected {
+			options.Args = map[string]interface{}{}
+		}
+		if options.Builder == "" {
+			return errors.New("no builder was detected for this project, choose one with --builder or build from a Dockerfile with --dockerfile")
+		}
+	}
+
+	for key, value := range i.Arg {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+			parsed = value
+		}
+		options.Args[key] = parsed
+	}
+	if options.Builder != "" && builders != nil {
+		builder, err := internal.ResolveBuilder(i.BuilderDir, options.Builder)
+		if err != nil {
+			return err
+		}
+		for _, required := range builder.Manifest.RequiredArgs {
+			if _, ok := options.Args[required]; ok {
+				continue
+			}
+			if _, ok := builder.Manifest.DefaultArgs[required]; ok {
+				continue
+			}
+			if value := prompter.ask("Builder arg "+required, ""); value != "" {
+				options.Args[required] = value
+			}
+		}
+	}
+
+	options.Ports = i.Port
+	if len(options.Ports) == 0 {
+		if port := prompter.ask("Container port the app listens on (blank for none)", ""); port != "" {
+			host, err := strconv.Atoi(prompter.ask("Host port to publish it on", strings.Split(port, "/")[0]))
+			if err != nil {
+				return fmt.Errorf("invalid host port: %w", err)
+			}
+			options.Ports = map[string]int{port: host}
+		}
+	}
+
+	options.Domain = prompter.ask("Domain (blank for none)", i.Domain)
+	if options.Domain != "" {
+		options.DomainPort = i.DomainPort
+		if options.DomainPort == 0 {
+			for _, host := range options.Ports {
+				options.DomainPort = max(options.DomainPort, host)
+			}
+		}
+	}
+
+	content, err := internal.RenderDeployConfig(options)
+	if err != nil {
+		return err
+	}
+	config, err := configs.ValidateDeployConfig(content)
+	if err != nil {
+		return fmt.Errorf("the generated config is invalid, adjust the flags and try again: %w", err)
+	}
+	if builders != nil {
+		if _, err = internal.ResolveBuildSource(*config, i.BuilderDir, cli.WorkingDir); err != nil {
+			return fmt.Errorf("the generated config does not work with the builder: %w", err)
+		}
+	}
+
+	err = os.WriteFile(target, []byte(content), 0644)
+	if err != nil {
+		slog.Error("could not write the deploy config", "path", target, "err", err)
+		return err
+	}
+
+	slog.Info("wrote deploy config", "path", target)
+	return nil
+}
+
+// prompter asks for values on the terminal, returning the default straight away when not running interactively
+type prompter struct {
+	reader      *bufio.Reader
+	interactive bool
+}
+
+func (p prompter) ask(question string, fallback string) string {
+	if !p.interactive {
+		return fallback
+	}
+
+	if fallback != "" {
+		fmt.Printf("%v [%v]: ", question, fallback)
+	} else {
+		fmt.Printf("%v: ", question)
+	}
+
+	answer, _ := p.reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return fallback
+	}
+	return answer
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+type Trigger struct {
+	Repo         string            `arg:"" help:"The full name of the repository to build, ie ryan/test-deploy"`
+	Server       string            `help:"The url of the webhook server" default:"http://127.0.0.1:15342"`
+	Token        string            `help:"An API token with the deployer role, see the token command" env:"ECHOCICD_TOKEN"`
+	Ref          string            `help:"The ref to build, defaults to the default branch of the repository"`
+	Commit       string            `help:"The commit to build, defaults to the head of the ref"`
+	Clone        string            `help:"The url to clone the repository from if the server has no git base url, requires an admin token"`
+	Arg          map[string]string `help:"Builder arg overrides, values are parsed as JSON where possible"`
+	Follow       bool              `help:"Follow the build log until the build completes"`
+	IgnoreWindow bool              `help:"Deploy the build straight away even if it is outside the project's deploy window"`
+}
+
+func (t Trigger) Run() error {
+	args := map[string]interface{}{}
+	for k, v := range t.Arg {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(v), &parsed); err != nil {
+			parsed = v
+		}
+		args[k] = parsed
+	}
+
+	client := internal.TriggerClient{Server: t.Server, Token: t.Token}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	record, err := client.Trigger(ctx, internal.TriggerRequest{
+		Repo:         t.Repo,
+		CloneUrl:     t.Clone,
+		Ref:          t.Ref,
+		Commit:       t.Commit,
+		Args:         args,
+		IgnoreWindow: t.IgnoreWindow,
+	})
+	if err != nil {
+		slog.Error("failed to trigger build", "err", err)
+		return err
+	}
+
+	slog.Info("build queued", "id", record.Id, "repo", record.Repo, "ref", record.Ref)
+	if !t.Follow {
+		return nil
+	}
+
+	err = client.Follow(ctx, record.Id, os.Stdout)
+	if err != nil {
+		slog.Error("failed to follow build log", "err", err)
+		return err
+	}
+
+	record, err = client.Get(ctx, record.Id)
+	if err != nil {
+		slog.Error("failed to get build status", "err", err)
+		return err
+	}
+
+	if record.Status != internal.BuildSucceeded {
+		slog.Error("build did not succeed", "id", record.Id, "status", record.Status, "err", record.Error)
+		return fmt.Errorf("build %v %v", record.Id, record.Status)
+	}
+
+	slog.Info("build succeeded", "id", record.Id)
+	return nil
+}
+
+type Undeploy struct {
+	Repo            string `arg:"" help:"The full name of the repository to stop, ie ryan/test-deploy"`
+	Env             string `help:"The environment to stop, defaults to the builds made without an environment"`
+	AllEnvironments bool   `help:"Stop every environment and preview of the repository"`
+	PurgeHistory    bool   `help:"Forget every build published for the project"`
+	PurgeImages     bool   `help:"Remove the image of the current build from each agent"`
+}
+
+func (u Undeploy) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	keys := []string{internal.DeploymentKey(u.Repo, u.Env)}
+	if u.AllEnvironments {
+		builds, err := etcd.ListStoredConfigs(context.Background())
+		if err != nil {
+			slog.Error("failed to list builds", "err", err)
+			return err
+		}
+
+		keys = keys[:0]
+		for _, build := range builds {
+			if internal.RepoFromProjectKey(build.Key) == u.Repo {
+				keys = append(keys, build.Key)
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("no builds have been published for %v", u.Repo)
+		}
+	}
+
+	for _, key := range keys {
+		err = etcd.Undeploy(context.Background(), key, u.PurgeHistory, u.PurgeImages)
+		if err != nil {
+			slog.Error("failed to undeploy project", "key", key, "err", err)
+			return err
+		}
+		slog.Info("project undeployed, agents will stop its containers", "key", key)
+	}
+	return nil
+}
+
+type Restore struct {
+	Repo string `arg:"" help:"The full name of the repository to restore, ie ryan/test-deploy"`
+	Env  string `help:"The environment to restore, defaults to the builds made without an environment"`
+}
+
+func (r Restore) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	key := internal.DeploymentKey(r.Repo, r.Env)
+	err = etcd.Restore(context.Background(), key)
+	if err != nil {
+		slog.Error("failed to restore project", "key", key, "err", err)
+		return err
+	}
+
+	slog.Info("project restored, its next build will be deployed", "key", key)
+	return nil
+}
+
+type Promote struct {
+	Repo         string  `arg:"" help:"The full name of the repository to promote, ie ryan/test-deploy"`
+	From         string  `help:"The environment whose build is promoted, defaults to the builds made without an environment"`
+	To           string  `help:"The environment to deploy the build to, defaults to the builds made without an environment"`
+	DeployConfig string  `help:"The deploy config to read the target environment's name and exec config from, defaults to those of its last build" type:"path"`
+	Retag        bool    `help:"Push the image under the target environment's name as well"`
+	SkipApproval bool    `help:"Deploy the build straight away even if the target environment requires approval"`
+	PushAuth     *string `help:"The encoded authentication to pass to the push command, overrides the docker config" env:"PUSH_AUTH"`
+	DockerConfig string  `help:"The docker config.json to read registry credentials from, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json" type:"path"`
+	DockerHost   string  `help:"The docker host used to retag, defaults to unix:///var/run/docker.sock" default:"unix:///var/run/docker.sock"`
+}
+
+func (p Promote) Run() error {
+	options := internal.PromoteOptions{Repo: p.Repo, From: p.From, To: p.To, Retag: p.Retag, SkipApproval: p.SkipApproval}
+	if p.DeployConfig != "" {
+		config, err := configs.LoadDeployConfigFromFile(p.DeployConfig)
+		if err == nil && p.To != "" {
+			config, err = config.ForEnvironment(p.To)
+		}
+		if err != nil {
+			slog.Error("failed to process deploy config", "err", err)
+			return err
+		}
+		options.Name, options.Exec = config.Global.Name, &config.Exec
+	}
+
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	var conn *docker.Client
+	var auths *internal.RegistryAuths
+	if p.Retag {
+		conn, err = docker.NewClientWithOpts(docker.WithHost(p.DockerHost))
+		if err != nil {
+			slog.Error("could not connect to docker host", "err", err)
+			return err
+		}
+
+		auths, err = loadRegistryAuths(p.PushAuth, p.DockerConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	build, err := internal.Promote(ctx, etcd, conn, auths, options, os.Stdout)
+	if err != nil {
+		slog.Error("failed to promote build", "err", err)
+		return err
+	}
+
+	if build.Exec.Approval == configs.ApprovalManual && !p.SkipApproval {
+		slog.Info("build promoted, it is waiting for approval", "key", build.Key, "version", build.Version, "tag", build.Tag)
+		return nil
+	}
+	slog.Info("build promoted, agents will deploy it", "key", build.Key, "version", build.Version, "tag", build.Tag)
+	return nil
+}
+
+type Freeze struct {
+	Repo   string `arg:"" help:"The full name of the repository to freeze, ie ryan/test-deploy"`
+	Env    string `help:"The environment to freeze, defaults to the builds made without an environment"`
+	Reason string `help:"Why the project is frozen, shown alongside the freeze"`
+}
+
+func (f Freeze) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	key := internal.DeploymentKey(f.Repo, f.Env)
+	err = etcd.Freeze(context.Background(), key, f.Reason)
+	if err != nil {
+		slog.Error("failed to freeze project", "key", key, "err", err)
+		return err
+	}
+
+	slog.Info("project frozen, new builds will not be deployed until it is unfrozen", "key", key)
+	return nil
+}
+
+type Unfreeze struct {
+	Repo string `arg:"" help:"The full name of the repository to unfreeze, ie ryan/test-deploy"`
+	Env  string `help:"The environment to unfreeze, defaults to the builds made without an environment"`
+}
+
+func (u Unfreeze) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	key := internal.DeploymentKey(u.Repo, u.Env)
+	err = etcd.Unfreeze(context.Background(), key)
+	if err != nil {
+		slog.Error("failed to unfreeze project", "key", key, "err", err)
+		return err
+	}
+
+	slog.Info("project unfrozen, agents will deploy the latest build if it was held back", "key", key)
+	return nil
+}
+
+type Approve struct {
+	Repo         string `arg:"" help:"The full name of the repository to approve, ie ryan/test-deploy"`
+	Version      string `arg:"" optional:"" help:"The commit hash expected to be waiting for approval, defaults to whichever build is waiting"`
+	Env          string `help:"The environment to approve, defaults to the builds made without an environment"`
+	IgnoreWindow bool   `help:"Deploy the build straight away even if it is outside the project's deploy window"`
+}
+
+func (a Approve) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	key := internal.DeploymentKey(a.Repo, a.Env)
+	build, err := etcd.Approve(context.Background(), key, a.Version, a.IgnoreWindow)
+	if err != nil {
+		slog.Error("failed to approve build", "key", key, "err", err)
+		return err
+	}
+
+	slog.Info("build approved, agents will deploy it", "key", key, "version", build.Version, "ref", build.Ref)
+	return nil
+}
+
+type TokenCreate struct {
+	Name  string   `arg:"" help:"A name to help identify what the token is used for"`
+	Role  string   `help:"The role granted to the token: viewer, deployer or admin" enum:"viewer,deployer,admin" default:"viewer"`
+	Repos []string `help:"Globs of the repos the token can access, ie ryan/* - defaults to every repo" default:"*"`
+}
+
+func (t TokenCreate) Run() error {
+	role, err := internal.ParseRole(t.Role)
+	if err != nil {
+		return err
+	}
+
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	plain, token, err := etcd.CreateToken(context.Background(), t.Name, role, t.Repos)
+	if err != nil {
+		slog.Error("failed to create token", "err", err)
+		return err
+	}
+
+	slog.Info("created token, it will not be shown again", "id", token.Id, "role", token.Role, "repos", token.Repos)
+	fmt.Println(plain)
+	return nil
+}
+
+type TokenRevoke struct {
+	Id string `arg:"" help:"The id of the token to revoke"`
+}
+
+func (t TokenRevoke) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	err = etcd.RevokeToken(context.Background(), t.Id)
+	if err != nil {
+		slog.Error("failed to revoke token", "err", err)
+		return err
+	}
+
+	slog.Info("revoked token", "id", t.Id)
+	return nil
+}
+
+type TokenList struct{}
+
+func (t TokenList) Run() error {
+	etcd, err := internal.NewClient(cli.EtcdEndpoints)
+	if err != nil {
+		slog.Error("could not connect to etcd server", "err", err)
+		return err
+	}
+
+	tokens, err := etcd.ListTokens(context.Background())
+	if err != nil {
+		slog.Error("failed to list tokens", "err", err)
+		return err
+	}
+
+	for _, token := range tokens {
+		fmt.Printf("%v\t%v\t%v\t%v\n", token.Id, token.Role, strings.Join(token.Repos, ","), token.Name)
+	}
+	return nil
+}
+
+type Token struct {
+	Create TokenCreate `cmd:"" help:"Create a new API token"`
+	Revoke TokenRevoke `cmd:"" help:"Revoke an API token"`
+	List   TokenList   `cmd:"" help:"List API tokens"`
+}
+
 var cli struct {
 	EtcdEndpoints []string `help:"The etcd endpoints to which values should be read / written"`
 	WorkingDir    string   `help:"The directory to operate in" default:"."`
@@ -117,6 +764,16 @@ var cli struct {
 	Build         Build    `cmd:"" help:"Trigger a build in the current folder"`
 	WebhookServer Webhook  `cmd:"" help:"Launch the webhook server"`
 	Agent         Agent    `cmd:"" help:"Launch the agent which will be responsible for starting containers"`
+	Trigger       Trigger  `cmd:"" help:"Trigger a build on a remote webhook server"`
+	Validate      Validate `cmd:"" help:"Check a deploy config for problems without building it"`
+	Init          Init     `cmd:"" help:"Create a deploy config for the project in the working directory"`
+	Undeploy      Undeploy `cmd:"" help:"Stop a project on every agent until it is restored"`
+	Restore       Restore  `cmd:"" help:"Allow an undeployed project to be deployed again by its next build"`
+	Approve       Approve  `cmd:"" help:"Deploy a build which is waiting for approval"`
+	Promote       Promote  `cmd:"" help:"Deploy the build of one environment to another without rebuilding it"`
+	Freeze        Freeze   `cmd:"" help:"Stop new builds of a project being deployed"`
+	Unfreeze      Unfreeze `cmd:"" help:"Deploy new builds of a frozen project again"`
+	Token         Token    `cmd:"" help:"Manage the API tokens used to access the webhook server"`
 }
 
 func main() {
@@ -0,0 +1,31 @@
+package configs
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+)
+
+// BuilderManifest is the builder.toml file that lives in the root of a builder
+type BuilderManifest struct {
+	Name         string                 `toml:"name"`
+	Version      string                 `toml:"version"`
+	Description  string                 `toml:"description"`
+	RequiredArgs []string               `toml:"required_args"`
+	DefaultArgs  map[string]interface{} `toml:"default_args"`
+	Platforms    []string               `toml:"platforms"`
+}
+
+func LoadBuilderManifestFromFile(path string) (*BuilderManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read builder manifest: %w", err)
+	}
+
+	var manifest BuilderManifest
+	if _, err := toml.Decode(string(content), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse builder manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,64 @@
+// The schema every .deploy-config.toml is checked against after it is parsed
+
+#Port: int & >0 & <65536
+
+// A host port of 0 is allocated by the agent
+#HostPort: int & >=0 & <65536
+
+#Duration: string & =~"^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$"
+
+#DeployConfig: {
+	global: {
+		name:  string & =~"^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"
+		repo:  string & =~"^[^/\\s]+/[^/\\s]+$"
+	}
+
+	builder?: {
+		id?:         string
+		exclude?:    [...string]
+		args?:       {...}
+		timeout?:    #Duration
+		precedence?: "error" | "builder" | "project"
+		dockerfile?: string
+		context?:    string
+		target?:     string
+		labels?:     [string]: string
+		platform?:   string
+	}
+
+	exec?: {
+		env?:           [string]: string
+		args?:          [...string]
+		approval?:      "automatic" | "manual"
+		deploy_window?: string & !=""
+		replicas?:      int & >=0
+		ports?: [=~"^[0-9]+(/(tcp|udp|sctp))?$"]: #HostPort
+		volumes?: [...{
+			readonly?: bool
+			host:      string
+			bindTo:    string & !=""
+			mode?:     string
+		}]
+		domain?: {
+			port: #Port
+			host: string & !=""
+		}
+	}
+
+	preview?: {
+		refs:    [...string]
+		domain?: string & =~"^[a-z0-9.-]+$"
+		ttl?:    #Duration
+	}
+
+	// Environments are merged over the rest of the config and checked again once merged, so their sections are open
+	env?: [string]: {
+		refs: [...string]
+		// Environments are always published under the base repo, so only the name can change
+		global?: {
+			name?: string
+		}
+		builder?: {...}
+		exec?: {...}
+	}
+}
@@ -1,20 +1,31 @@
 package configs
 
 import (
+	_ "embed"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"os"
+	"time"
 )
 
+//go:embed deploy-config.cue
+var deployConfigSchema []byte
+
 type GlobalProperties struct {
 	Name string `toml:"name"`
 	Repo string `toml:"repo"`
 }
 
 type BuilderProperties struct {
-	Id      string                 `toml:"id"`
-	Exclude []string               `toml:"exclude"`
-	Args    map[string]interface{} `toml:"args"`
+	Id         string                 `toml:"id"`
+	Exclude    []string               `toml:"exclude"`
+	Args       map[string]interface{} `toml:"args"`
+	Timeout    time.Duration          `toml:"timeout"`
+	Precedence string                 `toml:"precedence"`
+	Dockerfile string                 `toml:"dockerfile"`
+	Context    string                 `toml:"context"`
+	Target     string                 `toml:"target"`
+	Labels     map[string]string      `toml:"labels"`
+	Platform   string                 `toml:"platform"`
 }
 
 type VolumeMount struct {
@@ -27,6 +38,8 @@ type VolumeMount struct {
 type DomainConfiguration struct {
 	Port int    `toml:"port" json:"port"`
 	Host string `toml:"host" json:"host"`
+	// ContainerPort is set for previews, routing the domain to whichever host port the agent allocates for it
+	ContainerPort string `toml:"-" json:"containerPort,omitempty"`
 }
 
 type ExecProperties struct {
@@ -34,14 +47,50 @@ type ExecProperties struct {
 	Ports   map[string]int       `toml:"ports" json:"ports"`
 	Volumes []VolumeMount        `toml:"volumes" json:"volumes"`
 	Domain  *DomainConfiguration `toml:"domain" json:"domain"`
+	Env     map[string]string    `toml:"env" json:"env,omitempty"`
+	// Approval is ApprovalManual to hold each build until it is approved rather than deploying it straight away
+	Approval string `toml:"approval" json:"approval,omitempty"`
+	// DeployWindow limits when agents deploy new builds, see ParseDeployWindow
+	DeployWindow string `toml:"deploy_window" json:"deployWindow,omitempty"`
+	// Replicas is the number of containers to run on each agent. Fixed host ports become the start of a range with a
+	// port per replica
+	Replicas int `toml:"replicas" json:"replicas,omitempty"`
 }
 
-type DeployConfig struct {
+const (
+	ApprovalAutomatic = "automatic"
+	ApprovalManual    = "manual"
+)
+
+// EnvironmentConfig is an [env.<name>] block. Its global, builder and exec sections are merged over the base config
+// when building a ref matching one of its patterns
+type EnvironmentConfig struct {
+	Refs    []string          `toml:"refs"`
 	Global  GlobalProperties  `toml:"global"`
 	Builder BuilderProperties `toml:"builder"`
 	Exec    ExecProperties    `toml:"exec"`
 }
 
+type DeployConfig struct {
+	Global       GlobalProperties             `toml:"global"`
+	Builder      BuilderProperties            `toml:"builder"`
+	Exec         ExecProperties               `toml:"exec"`
+	Environments map[string]EnvironmentConfig `toml:"env"`
+	Preview      *PreviewProperties           `toml:"preview"`
+
+	// Environment is the name of the environment this config was produced for, empty for the base config
+	Environment string `toml:"-"`
+	// PreviewRef is the ref a preview config was produced for, empty if this is not a preview
+	PreviewRef string `toml:"-"`
+	// Ref is the git ref being built, defaulting to whatever is checked out
+	Ref string `toml:"-"`
+	// IgnoreWindow deploys the build straight away even if it is outside the exec deploy window
+	IgnoreWindow bool `toml:"-"`
+
+	// raw is the decoded toml the config was loaded from, used to merge environments over it
+	raw map[string]interface{}
+}
+
 func LoadDeployConfigFromFile(path string) (*DeployConfig, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
@@ -51,11 +100,8 @@ func LoadDeployConfigFromFile(path string) (*DeployConfig, error) {
 	return LoadDeployConfigFromString(string(content))
 }
 
+// LoadDeployConfigFromString parses and validates a deploy config, returning a ValidationError listing every problem
+// if it is invalid
 func LoadDeployConfigFromString(content string) (*DeployConfig, error) {
-	var conf DeployConfig
-	if _, err := toml.Decode(content, &conf); err != nil {
-		return nil, fmt.Errorf("failed to parse toml config: %w", err)
-	}
-
-	return &conf, nil
+	return ValidateDeployConfig(content)
 }
@@ -0,0 +1,125 @@
+package configs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+// MatchesRef returns true if the ref matches one of the environment's patterns. Patterns are globs matched with
+// path.Match against the full ref, or against the branch name for patterns that don't start with refs/
+func (environment EnvironmentConfig) MatchesRef(ref string) bool {
+	return slices.ContainsFunc(environment.Refs, func(pattern string) bool {
+		target := ref
+		if !strings.HasPrefix(pattern, "refs/") {
+			target = strings.TrimPrefix(ref, "refs/heads/")
+		}
+		matched, err := path.Match(pattern, target)
+		return err == nil && matched
+	})
+}
+
+// ForRef returns the configs to build for a ref, one for every environment whose patterns match it in name order. If
+// no environment matches, a ref matching [preview] builds a preview and anything else builds the base config
+func (config DeployConfig) ForRef(ref string) ([]DeployConfig, error) {
+	names := make([]string, 0, len(config.Environments))
+	for name, environment := range config.Environments {
+		if environment.MatchesRef(ref) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		if preview, ok := config.ForPreview(ref); ok {
+			return []DeployConfig{*preview}, nil
+		}
+		return []DeployConfig{config}, nil
+	}
+	slices.Sort(names)
+
+	result := make([]DeployConfig, 0, len(names))
+	for _, name := range names {
+		environment, err := config.ForEnvironment(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *environment)
+	}
+	return result, nil
+}
+
+// ForEnvironment deep merges the named environment over the base config. Tables are merged key by key while arrays,
+// such as volumes, are replaced. Unless the environment sets its own global.name it is named <name>-<environment>
+func (config DeployConfig) ForEnvironment(name string) (*DeployConfig, error) {
+	if _, ok := config.Environments[name]; !ok || config.raw == nil {
+		return nil, fmt.Errorf("the deploy config has no environment named %q", name)
+	}
+
+	base := maps.Clone(config.raw)
+	delete(base, "env")
+
+	environments, _ := config.raw["env"].(map[string]interface{})
+	overrides, _ := environments[name].(map[string]interface{})
+	overrides = maps.Clone(overrides)
+	delete(overrides, "refs")
+
+	merged := mergeTables(base, overrides)
+	global, _ := merged["global"].(map[string]interface{})
+	if _, named := nestedTable(overrides, "global")["name"]; !named && global != nil {
+		global["name"] = fmt.Sprintf("%v-%v", global["name"], name)
+	}
+
+	result, err := decodeRaw(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge environment %v: %w", name, err)
+	}
+	result.Environment = name
+	return result, nil
+}
+
+// mergeTables returns a copy of base with the overrides merged into it, recursing into tables present in both
+func mergeTables(base map[string]interface{}, overrides map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		if table, ok := value.(map[string]interface{}); ok {
+			value = mergeTables(table, nil)
+		}
+		result[key] = value
+	}
+
+	for key, value := range overrides {
+		overrideTable, overrideIsTable := value.(map[string]interface{})
+		baseTable, _ := result[key].(map[string]interface{})
+		if overrideIsTable {
+			result[key] = mergeTables(baseTable, overrideTable)
+		} else {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
+func nestedTable(table map[string]interface{}, key string) map[string]interface{} {
+	nested, _ := table[key].(map[string]interface{})
+	return nested
+}
+
+// decodeRaw turns decoded toml back into a config by encoding it again, which keeps the conversions (such as durations)
+// identical to loading a file
+func decodeRaw(raw map[string]interface{}) (*DeployConfig, error) {
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(raw); err != nil {
+		return nil, err
+	}
+
+	var config DeployConfig
+	if _, err := toml.Decode(buffer.String(), &config); err != nil {
+		return nil, err
+	}
+	config.raw = raw
+	return &config, nil
+}
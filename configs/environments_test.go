@@ -0,0 +1,164 @@
+package configs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+const environmentsConfig = `
+[global]
+name = "app"
+repo = "ryan/app"
+
+[builder]
+id = "golang"
+timeout = "10m"
+
+[builder.args]
+entrypoint = "main.go"
+tags = ["base"]
+
+[exec]
+args = ["-base"]
+env = { LOG_LEVEL = "info", REGION = "eu" }
+volumes = [{ host = "/srv/app", bindTo = "/data" }]
+
+[preview]
+refs = ["feature/*"]
+
+[env.staging]
+refs = ["develop", "release/*"]
+
+[env.staging.exec]
+env = { LOG_LEVEL = "debug" }
+
+[env.prod]
+refs = ["main", "refs/tags/v*"]
+
+[env.prod.global]
+name = "app-production"
+
+[env.prod.builder]
+timeout = "30m"
+
+[env.prod.builder.args]
+tags = ["prod"]
+
+[env.prod.exec]
+volumes = [{ host = "/srv/prod", bindTo = "/data" }]
+
+[env.canary]
+refs = ["main"]
+`
+
+func TestMatchesRef(t *testing.T) {
+	cases := []struct {
+		refs    []string
+		ref     string
+		matches bool
+	}{
+		{[]string{"main"}, "refs/heads/main", true},
+		{[]string{"main"}, "refs/heads/maintenance", false},
+		{[]string{"release/*"}, "refs/heads/release/1.2", true},
+		{[]string{"release/*"}, "refs/heads/release/1.2/hotfix", false},
+		{[]string{"refs/tags/v*"}, "refs/tags/v1.0.0", true},
+		{[]string{"v*"}, "refs/tags/v1.0.0", false},
+		{[]string{"refs/heads/main"}, "refs/heads/main", true},
+		{[]string{"develop", "main"}, "refs/heads/main", true},
+		{[]string{"[invalid"}, "refs/heads/main", false},
+		{nil, "refs/heads/main", false},
+	}
+
+	for _, c := range cases {
+		if matches := (EnvironmentConfig{Refs: c.refs}).MatchesRef(c.ref); matches != c.matches {
+			t.Errorf("expected %v matching %v to be %v", c.refs, c.ref, c.matches)
+		}
+	}
+}
+
+func TestForRef(t *testing.T) {
+	config, err := LoadDeployConfigFromString(environmentsConfig)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	cases := []struct {
+		ref          string
+		environments []string
+		names        []string
+	}{
+		{"refs/heads/main", []string{"canary", "prod"}, []string{"app-canary", "app-production"}},
+		{"refs/heads/develop", []string{"staging"}, []string{"app-staging"}},
+		{"refs/heads/release/2", []string{"staging"}, []string{"app-staging"}},
+		{"refs/tags/v1.0.0", []string{"prod"}, []string{"app-production"}},
+		{"refs/heads/other", []string{""}, []string{"app"}},
+	}
+	for _, c := range cases {
+		builds, err := config.ForRef(c.ref)
+		if err != nil {
+			t.Errorf("failed to select configs for %v: %v", c.ref, err)
+			continue
+		}
+
+		environments, names := make([]string, 0), make([]string, 0)
+		for _, build := range builds {
+			environments, names = append(environments, build.Environment), append(names, build.Global.Name)
+		}
+		if !slices.Equal(environments, c.environments) || !slices.Equal(names, c.names) {
+			t.Errorf("expected %v to build %v as %v, got %v as %v", c.ref, c.environments, c.names, environments, names)
+		}
+	}
+
+	// A ref matching no environment but matching [preview] builds a preview
+	builds, err := config.ForRef("refs/heads/feature/login")
+	if err != nil || len(builds) != 1 || builds[0].PreviewRef != "refs/heads/feature/login" {
+		t.Errorf("expected a feature branch to build a preview, got %v: %v", builds, err)
+	}
+}
+
+func TestForEnvironment(t *testing.T) {
+	config, err := LoadDeployConfigFromString(environmentsConfig)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	staging, err := config.ForEnvironment("staging")
+	if err != nil {
+		t.Fatalf("failed to merge staging: %v", err)
+	}
+	// Tables are merged key by key
+	if staging.Exec.Env["LOG_LEVEL"] != "debug" || staging.Exec.Env["REGION"] != "eu" {
+		t.Errorf("expected staging to override LOG_LEVEL and keep REGION, got %v", staging.Exec.Env)
+	}
+	if staging.Global.Repo != "ryan/app" || staging.Builder.Timeout != 10*time.Minute || !slices.Equal(staging.Exec.Args, []string{"-base"}) {
+		t.Errorf("expected staging to keep the base config, got %+v", staging)
+	}
+
+	prod, err := config.ForEnvironment("prod")
+	if err != nil {
+		t.Fatalf("failed to merge prod: %v", err)
+	}
+	if prod.Global.Name != "app-production" || prod.Global.Repo != "ryan/app" || prod.Environment != "prod" {
+		t.Errorf("expected prod to use its own name under the base repo, got %+v", prod.Global)
+	}
+	if prod.Builder.Timeout != 30*time.Minute || prod.Builder.Id != "golang" || prod.Builder.Args["entrypoint"] != "main.go" {
+		t.Errorf("expected prod to override the timeout and keep the rest of the builder, got %+v", prod.Builder)
+	}
+	// Arrays are replaced rather than appended to
+	if tags, _ := prod.Builder.Args["tags"].([]interface{}); len(tags) != 1 || tags[0] != "prod" {
+		t.Errorf("expected prod to replace the tags, got %v", prod.Builder.Args["tags"])
+	}
+	if len(prod.Exec.Volumes) != 1 || prod.Exec.Volumes[0].Host != "/srv/prod" {
+		t.Errorf("expected prod to replace the volumes, got %v", prod.Exec.Volumes)
+	}
+
+	// Merging an environment leaves the base config alone
+	if config.Exec.Env["LOG_LEVEL"] != "info" || config.Exec.Volumes[0].Host != "/srv/app" || config.Global.Name != "app" {
+		t.Errorf("expected the base config to be unchanged, got %+v", config)
+	}
+
+	if _, err = config.ForEnvironment("missing"); err == nil {
+		t.Errorf("expected an unknown environment to fail")
+	}
+}
@@ -0,0 +1,123 @@
+package configs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPreviewDomain is the domain previews are served under when [preview] does not set one
+const DefaultPreviewDomain = "preview.local"
+
+// DefaultPreviewTtl is how long a preview is kept without a push before it is torn down
+const DefaultPreviewTtl = 7 * 24 * time.Hour
+
+// PreviewProperties is the [preview] section, which deploys matching branches as their own short-lived deployment
+type PreviewProperties struct {
+	Refs   []string      `toml:"refs"`
+	Domain string        `toml:"domain"`
+	Ttl    time.Duration `toml:"ttl"`
+}
+
+// EffectiveTtl returns the configured ttl, or the default if none was set
+func (preview PreviewProperties) EffectiveTtl() time.Duration {
+	if preview.Ttl <= 0 {
+		return DefaultPreviewTtl
+	}
+	return preview.Ttl
+}
+
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// maxSlugLength keeps slugs short enough to use as a dns label alongside a prefix or suffix
+const maxSlugLength = 40
+
+// Slug turns a branch or project name into something usable in container names and domains. Values which have to be
+// changed to fit are suffixed with a short hash of the original, so feature/a, feature-a and Feature_A never share a
+// slug
+func Slug(value string) string {
+	return slugOf(value, value)
+}
+
+// slugOf slugs value, suffixing it with a hash of source if the slug doesn't match value exactly
+func slugOf(value string, source string) string {
+	slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(value), "-"), "-")
+	if slug == value && len(slug) <= maxSlugLength {
+		return slug
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	hash := hex.EncodeToString(sum[:])[:6]
+	if len(slug) > maxSlugLength-len(hash)-1 {
+		slug = strings.TrimRight(slug[:maxSlugLength-len(hash)-1], "-")
+	}
+	if slug == "" {
+		return hash
+	}
+	return slug + "-" + hash
+}
+
+// ForPreview returns the preview config for a ref if it matches the [preview] refs. Previews are named after the
+// branch, publish their ports on host ports allocated by the agent and are served on <branch>.<project>.<domain>
+func (config DeployConfig) ForPreview(ref string) (*DeployConfig, bool) {
+	if config.Preview == nil || !(EnvironmentConfig{Refs: config.Preview.Refs}).MatchesRef(ref) {
+		return nil, false
+	}
+
+	// The hash is of the whole ref, so a branch can't collide with a tag of the same name either
+	branch := slugOf(strings.TrimPrefix(ref, "refs/heads/"), ref)
+
+	preview := config
+	preview.Environment = "preview-" + branch
+	preview.PreviewRef = ref
+	preview.Global.Name = fmt.Sprintf("%v-%v", config.Global.Name, branch)
+
+	// Every port is published on a free host port, 0 asks the agent to pick one
+	preview.Exec.Ports = map[string]int{}
+	containerPorts := make([]string, 0, len(config.Exec.Ports))
+	for port := range config.Exec.Ports {
+		preview.Exec.Ports[port] = 0
+		containerPorts = append(containerPorts, port)
+	}
+	sort.Strings(containerPorts)
+
+	// The domain points at the port the base config routes to, or the first port if it doesn't have a domain
+	domain := config.Preview.Domain
+	if domain == "" {
+		domain = DefaultPreviewDomain
+	}
+	routed := ""
+	if config.Exec.Domain != nil {
+		routed = PortForDomain(config.Exec.Ports, config.Exec.Domain.Port)
+	}
+	if routed == "" && len(containerPorts) > 0 {
+		routed = containerPorts[0]
+	}
+	preview.Exec.Domain = nil
+	if routed != "" {
+		preview.Exec.Domain = &DomainConfiguration{
+			Host:          fmt.Sprintf("%v.%v.%v", branch, Slug(config.Global.Name), domain),
+			ContainerPort: routed,
+		}
+	}
+
+	// Previews must never touch the data of the deployment they preview, and deploy straight away as they are short
+	// lived and only seen by whoever pushed the branch
+	preview.Exec.Volumes = nil
+	preview.Exec.Approval, preview.Exec.DeployWindow = "", ""
+	return &preview, true
+}
+
+// PortForDomain finds the container port the domain port refers to, which may be either the host or container port
+func PortForDomain(ports map[string]int, domainPort int) string {
+	for port, host := range ports {
+		if host == domainPort || strings.Split(port, "/")[0] == fmt.Sprint(domainPort) {
+			return port
+		}
+	}
+	return ""
+}
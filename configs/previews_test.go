@@ -0,0 +1,100 @@
+package configs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlug(t *testing.T) {
+	cases := []struct {
+		value  string
+		slug   string
+		hashed bool
+	}{
+		{"main", "main", false},
+		{"release-1-2", "release-1-2", false},
+		{"feature/login", "feature-login", true},
+		{"Feature_Login", "feature-login", true},
+		{"---", "", true},
+		{strings.Repeat("a", 41), strings.Repeat("a", 33), true},
+	}
+
+	for _, c := range cases {
+		slug := Slug(c.value)
+		if !c.hashed {
+			if slug != c.slug {
+				t.Errorf("expected %q to be left as %q, got %q", c.value, c.slug, slug)
+			}
+			continue
+		}
+
+		// Changed values end with a six character hash of the original
+		prefix, hash := "", slug
+		if i := strings.LastIndex(slug, "-"); i >= 0 && c.slug != "" {
+			prefix, hash = slug[:i], slug[i+1:]
+		}
+		if prefix != c.slug || len(hash) != 6 || len(slug) > maxSlugLength {
+			t.Errorf("expected %q to be slugged as %q with a hash, got %q", c.value, c.slug, slug)
+		}
+	}
+
+	if Slug("feature/login") == Slug("feature-login") || Slug("feature/login") == Slug("Feature_Login") {
+		t.Errorf("expected branches which slug the same to get different hashes")
+	}
+}
+
+func TestForPreview(t *testing.T) {
+	config := DeployConfig{
+		Global: GlobalProperties{Name: "app", Repo: "ryan/app"},
+		Exec: ExecProperties{
+			Ports:        map[string]int{"8080/tcp": 80, "9090/tcp": 9090},
+			Volumes:      []VolumeMount{{Host: "/srv/app", BindTo: "/data"}},
+			Domain:       &DomainConfiguration{Port: 80, Host: "app.example.com"},
+			Approval:     ApprovalManual,
+			DeployWindow: "Mon-Fri 22:00-06:00",
+		},
+		Preview: &PreviewProperties{Refs: []string{"refs/heads/feature/*"}, Domain: "preview.example.com"},
+	}
+
+	if _, ok := config.ForPreview("refs/heads/main"); ok {
+		t.Fatalf("expected refs/heads/main to not be previewed")
+	}
+
+	preview, ok := config.ForPreview("refs/heads/feature/login")
+	if !ok {
+		t.Fatalf("expected refs/heads/feature/login to be previewed")
+	}
+
+	branch := slugOf("feature/login", "refs/heads/feature/login")
+	if !strings.HasPrefix(branch, "feature-login-") {
+		t.Fatalf("expected the branch slug to be hashed, got %v", branch)
+	}
+	if preview.Global.Name != "app-"+branch || preview.Environment != "preview-"+branch || preview.PreviewRef != "refs/heads/feature/login" {
+		t.Errorf("expected the preview to be named after its branch, got %v in %v", preview.Global.Name, preview.Environment)
+	}
+	if preview.Exec.Domain == nil || preview.Exec.Domain.Host != branch+".app.preview.example.com" || preview.Exec.Domain.ContainerPort != "8080/tcp" {
+		t.Errorf("expected the preview to be routed to 8080/tcp on its own domain, got %+v", preview.Exec.Domain)
+	}
+	for port, host := range preview.Exec.Ports {
+		if host != 0 {
+			t.Errorf("expected %v to be published on a port chosen by the agent, got %v", port, host)
+		}
+	}
+	if len(preview.Exec.Volumes) != 0 {
+		t.Errorf("expected previews to never mount the base config's volumes, got %v", preview.Exec.Volumes)
+	}
+	if preview.Exec.Approval != "" || preview.Exec.DeployWindow != "" {
+		t.Errorf("expected previews to deploy straight away, got approval %q and window %q", preview.Exec.Approval, preview.Exec.DeployWindow)
+	}
+
+	// The base config is left untouched
+	if config.Exec.Ports["8080/tcp"] != 80 || len(config.Exec.Volumes) != 1 || config.Exec.Domain.Host != "app.example.com" {
+		t.Errorf("expected the base config to be unchanged, got %+v", config.Exec)
+	}
+
+	// A tag with the same name as a branch gets a different slug
+	config.Preview.Refs = append(config.Preview.Refs, "refs/tags/feature/*")
+	if tag, ok := config.ForPreview("refs/tags/feature/login"); !ok || tag.Global.Name == preview.Global.Name {
+		t.Errorf("expected a tag to be previewed under a different name than the branch")
+	}
+}
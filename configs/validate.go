@@ -0,0 +1,392 @@
+package configs
+
+import (
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ValidationProblem is a single issue found in a deploy config. Line is 0 when the problem could not be tied to a line
+type ValidationProblem struct {
+	Line    int
+	Key     string
+	Message string
+}
+
+func (problem ValidationProblem) String() string {
+	parts := make([]string, 0, 3)
+	if problem.Line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d", problem.Line))
+	}
+	if problem.Key != "" {
+		parts = append(parts, problem.Key)
+	}
+	return strings.Join(append(parts, problem.Message), ": ")
+}
+
+// ValidationError is returned when a deploy config has one or more problems, all of which are reported together
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (err ValidationError) Error() string {
+	lines := make([]string, 0, len(err.Problems))
+	for _, problem := range err.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return "deploy config is invalid:\n" + strings.Join(lines, "\n")
+}
+
+var portPattern = regexp.MustCompile(`^[0-9]+(/(tcp|udp|sctp))?$`)
+
+// Validate checks the values in the config make sense together. Problems are keyed but have no line numbers, use
+// ValidateDeployConfig to validate the original file with line numbers
+func (config DeployConfig) Validate() []ValidationProblem {
+	problems := make([]ValidationProblem, 0)
+	add := func(key string, format string, args ...any) {
+		problems = append(problems, ValidationProblem{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if config.Global.Name == "" {
+		add("global.name", "is required")
+	}
+	if config.Global.Repo == "" {
+		add("global.repo", "is required")
+	}
+
+	if config.Builder.Id != "" && config.Builder.Dockerfile != "" {
+		add("builder.dockerfile", "cannot be used alongside builder.id")
+	}
+	if config.Builder.Id == "" && config.Builder.Dockerfile == "" {
+		add("builder.id", "either builder.id or builder.dockerfile is required")
+	}
+	if config.Builder.Timeout < 0 {
+		add("builder.timeout", "cannot be negative")
+	}
+	if config.Builder.Precedence != "" && !slices.Contains([]string{"error", "builder", "project"}, config.Builder.Precedence) {
+		add("builder.precedence", "must be one of error, builder or project, got %q", config.Builder.Precedence)
+	}
+
+	containerPorts := make([]int, 0, len(config.Exec.Ports))
+	hostPorts := make([]int, 0, len(config.Exec.Ports))
+	for port, host := range config.Exec.Ports {
+		key := "exec.ports." + port
+		if !portPattern.MatchString(port) {
+			add(key, "%q is not a valid container port, expected a number optionally followed by /tcp, /udp or /sctp", port)
+		} else {
+			number, _ := strconv.Atoi(strings.Split(port, "/")[0])
+			containerPorts = append(containerPorts, number)
+		}
+		// A host port of 0 asks the agent to allocate a free one
+		if host < 0 || host > 65535 {
+			add(key, "host port %v is out of range", host)
+		}
+		hostPorts = append(hostPorts, host)
+	}
+
+	// With replicas each fixed host port is the start of a range with a port per replica, which must not run into another
+	if config.Exec.Replicas < 0 {
+		add("exec.replicas", "cannot be negative")
+	}
+	if config.Exec.Replicas > 1 {
+		replicas := config.Exec.Replicas
+		for port, host := range config.Exec.Ports {
+			if host == 0 {
+				continue
+			}
+			if host+replicas-1 > 65535 {
+				add("exec.ports."+port, "host ports %v-%v for %v replicas are out of range", host, host+replicas-1, replicas)
+			}
+			for other, otherHost := range config.Exec.Ports {
+				if other < port && otherHost != 0 && host < otherHost+replicas && otherHost < host+replicas {
+					add("exec.ports."+port, "host ports %v-%v for %v replicas overlap those of %v", host, host+replicas-1, replicas, other)
+				}
+			}
+		}
+	}
+
+	for i, volume := range config.Exec.Volumes {
+		if volume.Host == "" {
+			add(fmt.Sprintf("exec.volumes.%d.host", i), "is required")
+		}
+		if volume.BindTo == "" {
+			add(fmt.Sprintf("exec.volumes.%d.bindTo", i), "is required")
+		}
+	}
+
+	if config.Exec.Approval != "" && !slices.Contains([]string{ApprovalAutomatic, ApprovalManual}, config.Exec.Approval) {
+		add("exec.approval", "must be one of automatic or manual, got %q", config.Exec.Approval)
+	}
+
+	if config.Exec.DeployWindow != "" {
+		if _, err := ParseDeployWindow(config.Exec.DeployWindow); err != nil {
+			add("exec.deploy_window", "%v", err)
+		}
+	}
+
+	if config.Exec.Domain != nil {
+		if config.Exec.Domain.Host == "" {
+			add("exec.domain.host", "is required")
+		}
+		if config.Exec.Domain.ContainerPort == "" && !slices.Contains(hostPorts, config.Exec.Domain.Port) && !slices.Contains(containerPorts, config.Exec.Domain.Port) {
+			add("exec.domain.port", "%v is not one of the ports in exec.ports", config.Exec.Domain.Port)
+		}
+	}
+
+	if config.Preview != nil {
+		if len(config.Preview.Refs) == 0 {
+			add("preview.refs", "at least one ref pattern is required")
+		}
+		if config.Preview.Ttl < 0 {
+			add("preview.ttl", "cannot be negative")
+		}
+	}
+
+	return problems
+}
+
+// isBuilderArg returns true for keys within builder.args, or within the builder args of an environment
+func isBuilderArg(key toml.Key) bool {
+	if len(key) > 3 && key[0] == "env" {
+		key = key[2:]
+	}
+	return len(key) > 2 && key[0] == "builder" && key[1] == "args"
+}
+
+// ValidateDeployConfig parses the content of a deploy config and reports every problem found in it with line numbers:
+// invalid toml, values of the wrong type, unknown keys, anything the CUE schema rejects and the checks in Validate
+func ValidateDeployConfig(content string) (*DeployConfig, error) {
+	lines := keyLines(content)
+	problems := make([]ValidationProblem, 0)
+	add := func(problem ValidationProblem) {
+		if problem.Line == 0 {
+			problem.Line = lines.lookup(problem.Key)
+		}
+		// Several passes can spot the same mistake, only the first report for each key is kept
+		if problem.Key != "" && slices.ContainsFunc(problems, func(existing ValidationProblem) bool {
+			return existing.Key == problem.Key
+		}) {
+			return
+		}
+		problems = append(problems, problem)
+	}
+
+	var raw map[string]interface{}
+	if _, err := toml.Decode(content, &raw); err != nil {
+		add(parseProblem(err))
+		return nil, ValidationError{Problems: problems}
+	}
+
+	var config DeployConfig
+	meta, err := toml.Decode(content, &config)
+	config.raw = raw
+	if err != nil {
+		add(parseProblem(err))
+	} else {
+		for _, key := range meta.Undecoded() {
+			// Builder args are free-form, but keys of nested tables within them are never marked as decoded
+			if isBuilderArg(key) {
+				continue
+			}
+			add(ValidationProblem{Key: strings.Join(key, "."), Message: "unknown key"})
+		}
+		for _, problem := range config.Validate() {
+			add(problem)
+		}
+	}
+
+	for _, problem := range schemaProblems(raw) {
+		add(problem)
+	}
+
+	// Each environment is checked once merged, only reporting problems the base config doesn't already have
+	if err == nil {
+		baseProblems := slices.Clone(problems)
+		for _, name := range sortedNames(config.Environments) {
+			prefix := "env." + name + "."
+			if len(config.Environments[name].Refs) == 0 {
+				add(ValidationProblem{Key: prefix + "refs", Message: "at least one ref pattern is required"})
+			}
+
+			environment, err := config.ForEnvironment(name)
+			if err != nil {
+				add(ValidationProblem{Key: "env." + name, Message: err.Error()})
+				continue
+			}
+
+			merged := slices.Concat(environment.Validate(), schemaProblems(environment.raw))
+			for _, problem := range merged {
+				if slices.ContainsFunc(baseProblems, func(existing ValidationProblem) bool {
+					return existing.Key == problem.Key
+				}) {
+					continue
+				}
+				problem.Key = prefix + problem.Key
+				add(problem)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, ValidationError{Problems: problems}
+	}
+	return &config, nil
+}
+
+// typeErrorPattern matches the errors returned when a toml value can't be decoded into the config struct, which are not
+// ParseErrors
+var typeErrorPattern = regexp.MustCompile(`^toml: (?:line (\d+) )?(?:\(last key "(.*)"\))?:? ?(.*)$`)
+
+func sortedNames(environments map[string]EnvironmentConfig) []string {
+	names := make([]string, 0, len(environments))
+	for name := range environments {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func parseProblem(err error) ValidationProblem {
+	// Syntax errors are only tied to a line, the last key is whichever key came before the mistake
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		message := parseErr.Message
+		if match := typeErrorPattern.FindStringSubmatch(parseErr.Error()); message == "" && match != nil {
+			message = match[3]
+		}
+		return ValidationProblem{Line: parseErr.Position.Line, Message: message}
+	}
+	if match := typeErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return ValidationProblem{Line: line, Key: match[2], Message: match[3]}
+	}
+	return ValidationProblem{Message: err.Error()}
+}
+
+// schemaProblems unifies the decoded toml with the CUE schema in deploy-config.cue, returning a problem per error
+func schemaProblems(raw map[string]interface{}) []ValidationProblem {
+	ctx := cuecontext.New()
+	schema := ctx.CompileBytes(deployConfigSchema, cue.Filename("deploy-config.cue"))
+	if schema.Err() != nil {
+		return []ValidationProblem{{Message: fmt.Sprintf("failed to compile deploy config schema: %v", schema.Err())}}
+	}
+
+	value := schema.LookupPath(cue.ParsePath("#DeployConfig")).Unify(ctx.Encode(raw))
+	err := value.Validate(cue.Concrete(true))
+	if err == nil {
+		return nil
+	}
+
+	problems := make([]ValidationProblem, 0)
+	for _, cueErr := range cueerrors.Errors(err) {
+		path := make([]string, 0)
+		for _, segment := range cueErr.Path() {
+			if !strings.HasPrefix(segment, "#") {
+				path = append(path, strings.Trim(segment, `"`))
+			}
+		}
+		format, args := cueErr.Msg()
+		problems = append(problems, ValidationProblem{Key: strings.Join(path, "."), Message: fmt.Sprintf(format, args...)})
+	}
+	return problems
+}
+
+// keyLineIndex maps every key in a toml document, with array indices removed, to the lines it appears on in order
+type keyLineIndex map[string][]int
+
+// keyLines finds the line of each key and table header in a toml document. It only understands as much toml as is
+// needed to point at the right line, keys set inside inline tables are attributed to the key holding the table
+func keyLines(content string) keyLineIndex {
+	index := keyLineIndex{}
+	table := ""
+	multiline := ""
+
+	for i, line := range strings.Split(content, "\n") {
+		number := i + 1
+		trimmed := strings.TrimSpace(line)
+
+		if multiline != "" {
+			if strings.Count(trimmed, multiline)%2 == 1 {
+				multiline = ""
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+		case strings.HasPrefix(trimmed, "[["):
+			table = normaliseKey(strings.TrimSuffix(strings.TrimPrefix(stripComment(trimmed), "[["), "]]"))
+			index[table] = append(index[table], number)
+		case strings.HasPrefix(trimmed, "["):
+			table = normaliseKey(strings.TrimSuffix(strings.TrimPrefix(stripComment(trimmed), "["), "]"))
+			index[table] = append(index[table], number)
+		default:
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				continue
+			}
+			full := normaliseKey(key)
+			if table != "" {
+				full = table + "." + full
+			}
+			index[full] = append(index[full], number)
+
+			for _, quote := range []string{`"""`, `'''`} {
+				if strings.Count(value, quote)%2 == 1 {
+					multiline = quote
+				}
+			}
+		}
+	}
+
+	return index
+}
+
+func stripComment(line string) string {
+	if position := strings.LastIndex(line, "#"); position > strings.LastIndex(line, "]") {
+		line = line[:position]
+	}
+	return strings.TrimSpace(line)
+}
+
+func normaliseKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// lookup returns the line of a dotted key, where numeric segments are array indices. Keys which can't be found are
+// looked up without their last segment, so a key inside an inline table resolves to the line of the table
+func (index keyLineIndex) lookup(key string) int {
+	segments := strings.Split(key, ".")
+	for len(segments) > 0 && segments[0] != "" {
+		path := make([]string, 0, len(segments))
+		occurrence := 0
+		for _, segment := range segments {
+			if number, err := strconv.Atoi(segment); err == nil {
+				occurrence = number
+				continue
+			}
+			path = append(path, segment)
+		}
+
+		if lines, ok := index[strings.Join(path, ".")]; ok {
+			if occurrence < len(lines) {
+				return lines[occurrence]
+			}
+			return lines[0]
+		}
+		segments = segments[:len(segments)-1]
+	}
+	return 0
+}
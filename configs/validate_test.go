@@ -0,0 +1,53 @@
+package configs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReplicaPorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas int
+		ports    map[string]int
+		// problems are the messages expected for the exec section, in order
+		problems []string
+	}{
+		{name: "single container", replicas: 1, ports: map[string]int{"8080": 65535, "9090": 65535}},
+		{name: "separate ranges", replicas: 3, ports: map[string]int{"8080": 9000, "9090": 9003}},
+		{name: "allocated ports", replicas: 3, ports: map[string]int{"8080": 0, "9090": 0}},
+		{name: "negative replicas", replicas: -1, problems: []string{"exec.replicas: cannot be negative"}},
+		{
+			name: "range past the last port", replicas: 3, ports: map[string]int{"8080": 65534},
+			problems: []string{"exec.ports.8080: host ports 65534-65536 for 3 replicas are out of range"},
+		},
+		{
+			name: "overlapping ranges", replicas: 3, ports: map[string]int{"8080": 9000, "9090": 9002},
+			problems: []string{"exec.ports.9090: host ports 9002-9004 for 3 replicas overlap those of 8080"},
+		},
+		{
+			name: "fixed host port out of range", replicas: 2, ports: map[string]int{"8080": 70000},
+			problems: []string{
+				"exec.ports.8080: host port 70000 is out of range",
+				"exec.ports.8080: host ports 70000-70001 for 2 replicas are out of range",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DeployConfig{Global: GlobalProperties{Name: "app", Repo: "ryan/app"}}
+			config.Exec.Replicas, config.Exec.Ports = test.replicas, test.ports
+
+			problems := make([]string, 0)
+			for _, problem := range config.Validate() {
+				if strings.HasPrefix(problem.Key, "exec.") {
+					problems = append(problems, problem.String())
+				}
+			}
+			if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+				t.Fatalf("expected problems %q, got %q", test.problems, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package configs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeployWindow is a weekly window in which deploys are allowed, such as Mon-Fri 22:00-06:00 Europe/London. A window
+// which ends before it starts runs overnight, and belongs to the day on which it starts
+type DeployWindow struct {
+	Days     [7]bool
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseDeployWindow parses a window written as <days> <start>-<end> [<time zone>]. Days are a comma separated list of
+// days and ranges of days, ie Mon-Fri,Sun, or * for every day. Times are HH:MM and the time zone defaults to UTC
+func ParseDeployWindow(value string) (*DeployWindow, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("deploy window %q should be written as <days> <start>-<end> [<time zone>]", value)
+	}
+
+	window := DeployWindow{Location: time.UTC}
+
+	if fields[0] == "*" {
+		window.Days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		for _, days := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(days, "-")
+			first, ok := weekdays[strings.ToLower(from)]
+			if !ok {
+				return nil, fmt.Errorf("deploy window has an unknown day %q", from)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdays[strings.ToLower(to)]; !ok {
+					return nil, fmt.Errorf("deploy window has an unknown day %q", to)
+				}
+			}
+			// Ranges can wrap around the end of the week, ie Sat-Mon
+			for day := first; ; day = (day + 1) % 7 {
+				window.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return nil, fmt.Errorf("deploy window times %q should be written as <start>-<end>", fields[1])
+	}
+	var err error
+	if window.Start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if window.End, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if window.Start == window.End {
+		return nil, fmt.Errorf("deploy window %v starts and ends at the same time", fields[1])
+	}
+
+	if len(fields) == 3 {
+		if window.Location, err = time.LoadLocation(fields[2]); err != nil {
+			return nil, fmt.Errorf("deploy window has an unknown time zone %q: %w", fields[2], err)
+		}
+	}
+
+	return &window, nil
+}
+
+// parseClock parses HH:MM into the time since midnight, allowing 24:00 for the end of the day
+func parseClock(value string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || len(value) != 5 {
+		return 0, fmt.Errorf("deploy window time %q should be written as HH:MM", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("deploy window time %q is not a valid time", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// clock returns the wall clock time of day, which unlike the time since midnight is unaffected by daylight saving
+func clock(local time.Time) time.Duration {
+	return time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+}
+
+// Contains returns true if deploys are allowed at the given time
+func (window DeployWindow) Contains(at time.Time) bool {
+	local := at.In(window.Location)
+	since := clock(local)
+
+	if window.Start < window.End {
+		return window.Days[local.Weekday()] && since >= window.Start && since < window.End
+	}
+
+	// Overnight windows are open from the start until midnight, then from midnight until the end the following day
+	yesterday := (local.Weekday() + 6) % 7
+	return (window.Days[local.Weekday()] && since >= window.Start) || (window.Days[yesterday] && since < window.End)
+}
+
+// Next returns the next time at or after the given time at which deploys are allowed
+func (window DeployWindow) Next(at time.Time) time.Time {
+	if window.Contains(at) {
+		return at
+	}
+
+	local := at.In(window.Location)
+	hour, minute := int(window.Start/time.Hour), int(window.Start%time.Hour/time.Minute)
+	for day := 0; day <= 7; day++ {
+		date := local.AddDate(0, 0, day)
+		opens := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, window.Location)
+		if window.Days[opens.Weekday()] && opens.After(at) {
+			return opens
+		}
+	}
+
+	// Unreachable as a window is open at least one day a week
+	return at
+}
@@ -0,0 +1,99 @@
+package configs
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("failed to parse %v: %v", value, err)
+	}
+	return parsed
+}
+
+func TestDeployWindowContains(t *testing.T) {
+	cases := []struct {
+		name   string
+		window string
+		at     string
+		open   bool
+	}{
+		{"before a daytime window", "Mon-Fri 09:00-17:00", "2024-03-04T08:59:00Z", false},
+		{"at the start of a daytime window", "Mon-Fri 09:00-17:00", "2024-03-04T09:00:00Z", true},
+		{"at the end of a daytime window", "Mon-Fri 09:00-17:00", "2024-03-04T17:00:00Z", false},
+		{"on a day outside the window", "Mon-Fri 09:00-17:00", "2024-03-02T12:00:00Z", false},
+		{"in a window in another time zone", "* 09:00-10:00 America/New_York", "2024-03-04T14:30:00Z", true},
+
+		{"before an overnight window", "Fri 22:00-06:00", "2024-03-01T21:59:00Z", false},
+		{"the evening of an overnight window", "Fri 22:00-06:00", "2024-03-01T23:00:00Z", true},
+		{"the morning after an overnight window", "Fri 22:00-06:00", "2024-03-02T05:59:00Z", true},
+		{"when an overnight window ends", "Fri 22:00-06:00", "2024-03-02T06:00:00Z", false},
+		{"the evening after an overnight window", "Fri 22:00-06:00", "2024-03-02T23:00:00Z", false},
+
+		// The clocks go forward at 01:00 UTC on the 31st of March 2024 in London, and back at 01:00 UTC on the 27th of
+		// October
+		{"before a window on the day the clocks go forward", "* 02:00-04:00 Europe/London", "2024-03-31T00:30:00Z", false},
+		{"in a window on the day the clocks go forward", "* 02:00-04:00 Europe/London", "2024-03-31T01:30:00Z", true},
+		{"after a window on the day the clocks go forward", "* 02:00-04:00 Europe/London", "2024-03-31T03:30:00Z", false},
+		{"before a window on the day the clocks go back", "* 02:00-04:00 Europe/London", "2024-10-27T01:30:00Z", false},
+		{"in a window on the day the clocks go back", "* 02:00-04:00 Europe/London", "2024-10-27T03:30:00Z", true},
+		{"after a window on the day the clocks go back", "* 02:00-04:00 Europe/London", "2024-10-27T04:00:00Z", false},
+		{"an overnight window as the clocks go forward", "Sat 23:00-03:00 Europe/London", "2024-03-31T01:30:00Z", true},
+		{"after an overnight window as the clocks go forward", "Sat 23:00-03:00 Europe/London", "2024-03-31T02:30:00Z", false},
+		{"an overnight window as the clocks go back", "Sat 23:00-03:00 Europe/London", "2024-10-27T02:30:00Z", true},
+		{"after an overnight window as the clocks go back", "Sat 23:00-03:00 Europe/London", "2024-10-27T03:00:00Z", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			window, err := ParseDeployWindow(c.window)
+			if err != nil {
+				t.Fatalf("failed to parse window: %v", err)
+			}
+			if open := window.Contains(mustParseTime(t, c.at)); open != c.open {
+				t.Errorf("expected %v to be open %v at %v, got %v", c.window, c.open, c.at, open)
+			}
+		})
+	}
+}
+
+func TestDeployWindowNext(t *testing.T) {
+	cases := []struct {
+		name   string
+		window string
+		at     string
+		opens  string
+	}{
+		{"while open", "Mon-Fri 09:00-17:00", "2024-03-04T10:00:00Z", "2024-03-04T10:00:00Z"},
+		{"later the same day", "Mon-Fri 09:00-17:00", "2024-03-04T08:00:00Z", "2024-03-04T09:00:00Z"},
+		{"over the weekend", "Mon-Fri 09:00-17:00", "2024-03-01T18:00:00Z", "2024-03-04T09:00:00Z"},
+		{"an overnight window a week later", "Fri 22:00-06:00", "2024-03-02T07:00:00Z", "2024-03-08T22:00:00Z"},
+		{"on the day the clocks go forward", "* 02:00-04:00 Europe/London", "2024-03-31T00:00:00Z", "2024-03-31T01:00:00Z"},
+		{"on the day the clocks go back", "* 02:00-04:00 Europe/London", "2024-10-27T00:00:00Z", "2024-10-27T02:00:00Z"},
+		{"the day after the clocks go forward", "* 02:00-04:00 Europe/London", "2024-03-31T04:00:00Z", "2024-04-01T01:00:00Z"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			window, err := ParseDeployWindow(c.window)
+			if err != nil {
+				t.Fatalf("failed to parse window: %v", err)
+			}
+			if opens := window.Next(mustParseTime(t, c.at)); !opens.Equal(mustParseTime(t, c.opens)) {
+				t.Errorf("expected %v to open at %v after %v, got %v", c.window, c.opens, c.at, opens.UTC())
+			}
+		})
+	}
+}
+
+func TestParseDeployWindowErrors(t *testing.T) {
+	for _, value := range []string{"", "Mon-Fri", "Mon-Fri 09:00", "Funday 09:00-17:00", "* 9:00-17:00", "* 09:00-09:00", "* 09:00-25:00", "* 09:00-17:00 Nowhere/Town"} {
+		if _, err := ParseDeployWindow(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
@@ -2,27 +2,342 @@ package internal
 
 import (
 	"context"
+	"echo-cicd/configs"
+	"errors"
+	"fmt"
 	docker "github.com/docker/docker/client"
 	"log/slog"
+	"sync"
+	"time"
 )
 
-func LaunchAgent(client *EtcdClient, conn *docker.Client, registryAuth map[string]string) {
-	slog.Info("waiting for new builds!")
-	client.WatchForBuild(context.Background(), func(config PublishedBuild) {
-		slog.Info("received a new build", "build", config.Name, "version", config.Version)
+const (
+	DeploymentRunning = "running"
+	DeploymentFailed  = "failed"
+	DeploymentRetired = "retired"
+	DeploymentFrozen  = "frozen"
+	DeploymentQueued  = "queued"
+)
+
+// LaunchAgent deploys every build published to etcd on this host. If caddy is set, the route of each project's domain
+// is managed through the Caddy admin API as well
+func LaunchAgent(client *EtcdClient, conn *docker.Client, registryAuths *RegistryAuths, agentId string, caddy *CaddyClient) {
+	slog.Info("waiting for new builds!", "agent", agentId)
+
+	// removeRoute drops a project's route from caddy once its containers are gone
+	removeRoute := func(key string) error {
+		if caddy == nil {
+			return nil
+		}
+		err := caddy.RemoveRoute(context.Background(), key)
+		if err != nil {
+			return fmt.Errorf("failed to remove caddy route: %w", err)
+		}
+		return nil
+	}
+
+	// updateRoute points the project's domain at its running containers, or removes its route if the domain was taken
+	// out of the config
+	updateRoute := func(config PublishedBuild) error {
+		if caddy == nil {
+			return nil
+		}
+		if config.Exec.Domain == nil {
+			return removeRoute(config.Key)
+		}
+
+		upstreams, err := ContainerUpstreams(config, conn)
+		if err != nil {
+			return fmt.Errorf("failed to find the upstreams for caddy: %w", err)
+		}
+		err = caddy.SetRoute(context.Background(), config.Key, config.Exec.Domain.Host, upstreams)
+		if err != nil {
+			return fmt.Errorf("failed to update caddy route: %w", err)
+		}
+		return nil
+	}
+
+	deploy := func(config PublishedBuild) {
+		status := DeploymentStatus{
+			Agent:   agentId,
+			Project: config.Key,
+			Name:    config.Name,
+			Version: config.Version,
+		}
+		defer func() {
+			err := client.WriteDeploymentStatus(context.Background(), status)
+			if err != nil {
+				slog.Error("failed to write deployment status", "name", config.Name, "version", config.Version, "err", err)
+			}
+		}()
+
+		if config.Exec.Replicas > 1 {
+			ids, err := DeployReplicas(config, conn, registryAuths)
+			// A roll that stopped part way leaves a mix of old and new replicas running, which the route follows
+			if len(ids) > 0 {
+				status.ContainerId, status.ContainerIds = ids[0], ids
+				err = errors.Join(err, updateRoute(config))
+			}
+			if err != nil {
+				slog.Error("failed to roll replicas", "name", config.Name, "version", config.Version, "err", err)
+				status.State, status.Error = DeploymentFailed, err.Error()
+				return
+			}
+
+			slog.Info("new replicas launched!", "name", config.Name, "version", config.Version, "replicas", len(ids))
+			status.State = DeploymentRunning
+			return
+		}
 
 		err := CleanupExistingContainers(config.Name, conn)
 		if err != nil {
 			slog.Error("failed to clean up previous containers", "name", config.Name, "version", config.Version, "err", err)
+			status.State, status.Error = DeploymentFailed, err.Error()
 			return
 		}
 
-		id, err := RunContainer(config, conn, registryAuth)
+		id, err := RunContainer(config, conn, registryAuths)
 		if err != nil {
 			slog.Error("failed to run new container", "name", config.Name, "version", config.Version, "err", err)
+			status.State, status.Error = DeploymentFailed, err.Error()
 			return
 		}
 
 		slog.Info("new container launched!", "name", config.Name, "version", config.Version, "id", *id)
+		status.State, status.ContainerId = DeploymentRunning, *id
+
+		err = updateRoute(config)
+		if err != nil {
+			slog.Error("failed to route domain", "name", config.Name, "version", config.Version, "err", err)
+			status.State, status.Error = DeploymentFailed, err.Error()
+		}
+	}
+
+	scheduler := newScheduler(client, agentId, deploy)
+	scheduler.Resume()
+
+	go client.WatchForRetired(context.Background(), func(config PublishedBuild) {
+		slog.Info("build was retired, removing its containers", "build", config.Name, "version", config.Version)
+		defer scheduler.Remove(config.Key)()
+
+		status := DeploymentStatus{
+			Agent:   agentId,
+			Project: config.Key,
+			Name:    config.Name,
+			Version: config.Version,
+			State:   DeploymentRetired,
+		}
+
+		err := errors.Join(removeRoute(config.Key), CleanupExistingContainers(config.Name, conn))
+		if err == nil && config.PurgeImages {
+			err = RemoveImage(config, conn)
+		}
+		if err != nil {
+			slog.Error("failed to remove retired containers", "name", config.Name, "err", err)
+			status.State, status.Error = DeploymentFailed, err.Error()
+		}
+
+		err = client.WriteDeploymentStatus(context.Background(), status)
+		if err != nil {
+			slog.Error("failed to write deployment status", "name", config.Name, "version", config.Version, "err", err)
+		}
+	}, false)
+
+	go client.WatchForDeleted(context.Background(), func(key string) {
+		slog.Info("build was deleted, removing its containers", "key", key)
+		defer scheduler.Remove(key)()
+
+		status := DeploymentStatus{Agent: agentId, Project: key, State: DeploymentRetired}
+		err := errors.Join(removeRoute(key), CleanupContainersForKey(key, conn))
+
+		// Containers launched before they were labelled with their key can only be found by the name this agent last
+		// deployed them under
+		previous, statusErr := client.GetDeploymentStatus(context.Background(), agentId, key)
+		if statusErr != nil {
+			slog.Error("failed to read previous deployment", "key", key, "err", statusErr)
+		} else if previous != nil && previous.Name != "" {
+			status.Name = previous.Name
+			err = errors.Join(err, CleanupExistingContainers(previous.Name, conn))
+		}
+
+		if err != nil {
+			slog.Error("failed to remove deleted containers", "key", key, "err", err)
+			status.State, status.Error = DeploymentFailed, err.Error()
+		}
+
+		err = client.WriteDeploymentStatus(context.Background(), status)
+		if err != nil {
+			slog.Error("failed to write deployment status", "key", key, "err", err)
+		}
+	})
+
+	go client.WatchForUnfrozen(context.Background(), scheduler.Unfrozen)
+
+	client.WatchForBuild(context.Background(), func(config PublishedBuild) {
+		slog.Info("received a new build", "build", config.Name, "version", config.Version)
+		scheduler.Apply(config)
 	}, false)
 }
+
+// scheduler decides when the agent deploys each build, holding builds back while their project is frozen or outside its
+// deploy window. Builds arrive from the build watcher, the unfreeze watcher and deploy window timers at once, so
+// deciding whether to deploy a build and deploying it happens under lock, otherwise an older build could be deployed
+// over a newer one. Only the newest build of each project is kept waiting for its window
+type scheduler struct {
+	client  *EtcdClient
+	agentId string
+	deploy  func(config PublishedBuild)
+
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newScheduler(client *EtcdClient, agentId string, deploy func(config PublishedBuild)) *scheduler {
+	return &scheduler{client: client, agentId: agentId, deploy: deploy, timers: map[string]*time.Timer{}}
+}
+
+// Apply deploys a build unless its project is frozen or it is outside its deploy window
+func (s *scheduler) Apply(config PublishedBuild) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.apply(config)
+}
+
+// apply is Apply for callers which hold the lock
+func (s *scheduler) apply(config PublishedBuild) {
+	freeze, err := s.client.GetFreeze(context.Background(), config.Key)
+	if err != nil {
+		slog.Error("failed to check whether the project is frozen, deploying anyway", "key", config.Key, "err", err)
+	}
+	if freeze != nil {
+		slog.Info("project is frozen, holding back the build", "build", config.Name, "version", config.Version, "reason", freeze.Reason)
+		s.stopTimer(config.Key)
+		s.hold(config, DeploymentFrozen, 0)
+		return
+	}
+
+	if config.Exec.DeployWindow != "" && !config.IgnoreWindow {
+		window, err := configs.ParseDeployWindow(config.Exec.DeployWindow)
+		if err != nil {
+			slog.Error("failed to parse deploy window, deploying anyway", "key", config.Key, "err", err)
+		} else if now := time.Now(); !window.Contains(now) {
+			opens := window.Next(now)
+			slog.Info("build is outside its deploy window, queueing it", "build", config.Name, "version", config.Version, "opens", opens)
+
+			s.stopTimer(config.Key)
+			s.timers[config.Key] = time.AfterFunc(opens.Sub(now), func() { s.release(config.Key) })
+			s.hold(config, DeploymentQueued, opens.UnixMilli())
+			return
+		}
+	}
+
+	s.stopTimer(config.Key)
+	s.deploy(config)
+}
+
+// release deploys the latest build of a project once its deploy window opens
+func (s *scheduler) release(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopTimer(key)
+	latest, err := s.client.GetStoredConfig(context.Background(), key)
+	if err != nil {
+		slog.Error("failed to load the queued build", "key", key, "err", err)
+		return
+	}
+	if latest.Retired == 0 {
+		s.apply(*latest)
+	}
+}
+
+// Unfrozen deploys the latest build of a project if it was held back by a freeze
+func (s *scheduler) Unfrozen(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous, err := s.client.GetDeploymentStatus(context.Background(), s.agentId, key)
+	if err != nil {
+		slog.Error("failed to read previous deployment", "key", key, "err", err)
+		return
+	}
+	if previous == nil || previous.State != DeploymentFrozen {
+		return
+	}
+
+	config, err := s.client.GetStoredConfig(context.Background(), key)
+	if err != nil {
+		slog.Error("failed to load the build held back by the freeze", "key", key, "err", err)
+		return
+	}
+	if config.Retired != 0 {
+		return
+	}
+
+	slog.Info("project was unfrozen, deploying the held back build", "build", config.Name, "version", config.Version)
+	s.apply(*config)
+}
+
+// Resume schedules the builds this agent had queued for their deploy window before it restarted, as those are only kept
+// on a timer, deploying any whose window opened while it was down
+func (s *scheduler) Resume() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses, err := s.client.ListDeploymentStatuses(context.Background(), "")
+	if err != nil {
+		slog.Error("failed to list queued builds", "agent", s.agentId, "err", err)
+	}
+	for _, status := range statuses {
+		if status.Agent != s.agentId || status.State != DeploymentQueued {
+			continue
+		}
+
+		config, err := s.client.GetStoredConfig(context.Background(), status.Project)
+		if err != nil {
+			slog.Error("failed to load the queued build", "key", status.Project, "err", err)
+			continue
+		}
+		if config.Retired != 0 {
+			continue
+		}
+
+		slog.Info("rescheduling queued build", "build", config.Name, "version", config.Version)
+		s.apply(*config)
+	}
+}
+
+// Remove drops the build of a project waiting for its deploy window and stops any build being deployed until the
+// returned function is called, so a deploy window timer or an unfreeze can never bring back a project while its
+// containers are being removed
+func (s *scheduler) Remove(key string) (done func()) {
+	s.lock.Lock()
+	s.stopTimer(key)
+	return s.lock.Unlock
+}
+
+// hold records that a build is not being deployed yet, keeping the running version in the status so it still shows what
+// is deployed
+func (s *scheduler) hold(config PublishedBuild, state string, scheduledFor int64) {
+	status := DeploymentStatus{Agent: s.agentId, Project: config.Key}
+	previous, err := s.client.GetDeploymentStatus(context.Background(), s.agentId, config.Key)
+	if err != nil {
+		slog.Error("failed to read previous deployment", "key", config.Key, "err", err)
+	} else if previous != nil {
+		status = *previous
+	}
+	status.Name, status.State, status.Pending, status.ScheduledFor, status.Error = config.Name, state, config.Version, scheduledFor, ""
+
+	err = s.client.WriteDeploymentStatus(context.Background(), status)
+	if err != nil {
+		slog.Error("failed to write deployment status", "name", config.Name, "version", config.Version, "err", err)
+	}
+}
+
+// stopTimer drops the build of a project waiting for its deploy window, the lock must be held
+func (s *scheduler) stopTimer(key string) {
+	if timer, ok := s.timers[key]; ok {
+		timer.Stop()
+		delete(s.timers, key)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"echo-cicd/configs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closedWindow returns a deploy window which is not open today or tomorrow
+func closedWindow() string {
+	day := (time.Now().UTC().Weekday() + 3) % 7
+	return strings.ToUpper(day.String()[:1]) + day.String()[1:3] + " 00:00-01:00"
+}
+
+// recordDeploys returns a deploy which records the version of each build deployed
+func recordDeploys() (func(config PublishedBuild), func() []string) {
+	var lock sync.Mutex
+	deployed := make([]string, 0)
+	return func(config PublishedBuild) {
+			lock.Lock()
+			defer lock.Unlock()
+			deployed = append(deployed, config.Version)
+		}, func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return slices.Clone(deployed)
+		}
+}
+
+func TestSchedulerUndeployWhileQueued(t *testing.T) {
+	ctx := context.Background()
+	client := newTestEtcd(t)
+	deploy, deployed := recordDeploys()
+	scheduler := newScheduler(client, "agent-1", deploy)
+
+	build := PublishedBuild{Key: "ryan__app", Name: "app", Repo: "ryan/app", Version: "aaaaaaa", Exec: configs.ExecProperties{DeployWindow: closedWindow()}}
+	if err := client.PublishBuild(ctx, build); err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+
+	scheduler.Apply(build)
+	status, err := client.GetDeploymentStatus(ctx, "agent-1", build.Key)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	if status == nil || status.State != DeploymentQueued || status.Pending != "aaaaaaa" {
+		t.Fatalf("expected the build to be queued for its window, got %+v", status)
+	}
+	if _, ok := scheduler.timers[build.Key]; !ok {
+		t.Fatalf("expected a timer waiting for the window to open")
+	}
+
+	if err = client.Undeploy(ctx, build.Key, false, false); err != nil {
+		t.Fatalf("failed to undeploy: %v", err)
+	}
+	scheduler.Remove(build.Key)()
+	if _, ok := scheduler.timers[build.Key]; ok {
+		t.Fatalf("expected the queued build to be dropped when the project is removed")
+	}
+
+	// Even a timer which already fired finds the project retired
+	scheduler.release(build.Key)
+	if versions := deployed(); len(versions) != 0 {
+		t.Fatalf("expected an undeployed project to never be deployed, got %v", versions)
+	}
+}
+
+func TestSchedulerResumesQueuedBuilds(t *testing.T) {
+	ctx := context.Background()
+	client := newTestEtcd(t)
+
+	queued := PublishedBuild{Key: "ryan__queued", Name: "queued", Repo: "ryan/queued", Version: "aaaaaaa", Exec: configs.ExecProperties{DeployWindow: closedWindow()}}
+	opened := PublishedBuild{Key: "ryan__opened", Name: "opened", Repo: "ryan/opened", Version: "bbbbbbb", Exec: configs.ExecProperties{DeployWindow: closedWindow()}}
+	for _, build := range []PublishedBuild{queued, opened} {
+		if err := client.PublishBuild(ctx, build); err != nil {
+			t.Fatalf("failed to publish build: %v", err)
+		}
+	}
+
+	deploy, deployed := recordDeploys()
+	before := newScheduler(client, "agent-1", deploy)
+	before.Apply(queued)
+	before.Apply(opened)
+	for _, timer := range before.timers {
+		timer.Stop()
+	}
+
+	// The window of one of the builds opens while the agent is down
+	opened.Exec.DeployWindow = ""
+	if err := client.PublishBuild(ctx, opened); err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+
+	after := newScheduler(client, "agent-1", deploy)
+	after.Resume()
+	if _, ok := after.timers[queued.Key]; !ok {
+		t.Errorf("expected the queued build to wait for its window again")
+	}
+	if versions := deployed(); !slices.Equal(versions, []string{"bbbbbbb"}) {
+		t.Errorf("expected only the build whose window opened to be deployed, got %v", versions)
+	}
+
+	// Other agents' queued builds are left to them
+	other := newScheduler(client, "agent-2", deploy)
+	other.Resume()
+	if len(other.timers) != 0 {
+		t.Errorf("expected agent-2 to have nothing to resume, got %v", other.timers)
+	}
+	for _, timer := range after.timers {
+		timer.Stop()
+	}
+}
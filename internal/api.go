@@ -0,0 +1,221 @@
+package internal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+//go:embed openapi.json
+var openApiDescription []byte
+
+// defaultHistoryLimit is the number of history entries returned when the request does not specify a limit
+const defaultHistoryLimit = 20
+
+// ApprovalRequest is the optional body of POST /api/projects/{project}/approve
+type ApprovalRequest struct {
+	Version      string `json:"version,omitempty"`
+	IgnoreWindow bool   `json:"ignore_window,omitempty"`
+}
+
+// RegisterApiHandlers adds the JSON API used to inspect projects, builds and deployments. Reads require a viewer
+// token, anything which changes state requires a deployer token, and results are limited to the repos the token can
+// access
+func RegisterApiHandlers(mux *http.ServeMux, configuration WebhookConfiguration) {
+	viewer := func(handler http.HandlerFunc) http.HandlerFunc {
+		return RequireRole(configuration.Etcd, RoleViewer, handler)
+	}
+	// project wraps handlers for a single project, rejecting tokens that cannot access its repo
+	project := func(handler http.HandlerFunc) http.HandlerFunc {
+		return viewer(func(writer http.ResponseWriter, request *http.Request) {
+			if !TokenFromContext(request.Context()).CanAccess(RepoFromProjectKey(request.PathValue("project"))) {
+				http.Error(writer, "project not found", http.StatusNotFound)
+				return
+			}
+			handler(writer, request)
+		})
+	}
+
+	mux.HandleFunc("GET /api/openapi.json", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_, err := writer.Write(openApiDescription)
+		if err != nil {
+			slog.Error("failed to write response", "err", err)
+		}
+	}))
+
+	mux.HandleFunc("GET /api/projects", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		builds, err := configuration.Etcd.ListStoredConfigs(request.Context())
+		if err != nil {
+			slog.Error("failed to list projects", "err", err)
+			http.Error(writer, "failed to list projects", http.StatusInternalServerError)
+			return
+		}
+
+		token := TokenFromContext(request.Context())
+		writeJson(writer, http.StatusOK, slices.DeleteFunc(builds, func(build PublishedBuild) bool {
+			return !token.CanAccess(RepoFromProjectKey(build.Key))
+		}))
+	}))
+
+	mux.HandleFunc("GET /api/projects/{project}", project(func(writer http.ResponseWriter, request *http.Request) {
+		build, err := configuration.Etcd.GetStoredConfig(request.Context(), request.PathValue("project"))
+		if errors.Is(err, ErrBuildNotFound) {
+			http.Error(writer, "project not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to load project", "err", err)
+			http.Error(writer, "failed to load project", http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(writer, http.StatusOK, build)
+	}))
+
+	mux.HandleFunc("GET /api/projects/{project}/history", project(func(writer http.ResponseWriter, request *http.Request) {
+		limit := int64(defaultHistoryLimit)
+		if raw := request.URL.Query().Get("limit"); raw != "" {
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || parsed <= 0 {
+				http.Error(writer, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		history, err := configuration.Etcd.GetHistory(request.Context(), request.PathValue("project"), limit)
+		if err != nil {
+			slog.Error("failed to load history", "err", err)
+			http.Error(writer, "failed to load history", http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(writer, http.StatusOK, history)
+	}))
+
+	mux.HandleFunc("GET /api/projects/{project}/deployments", project(func(writer http.ResponseWriter, request *http.Request) {
+		statuses, err := configuration.Etcd.ListDeploymentStatuses(request.Context(), request.PathValue("project"))
+		if err != nil {
+			slog.Error("failed to list deployments", "err", err)
+			http.Error(writer, "failed to list deployments", http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(writer, http.StatusOK, statuses)
+	}))
+
+	mux.HandleFunc("GET /api/projects/{project}/pending", project(func(writer http.ResponseWriter, request *http.Request) {
+		build, err := configuration.Etcd.GetPendingBuild(request.Context(), request.PathValue("project"))
+		if err != nil {
+			slog.Error("failed to load pending build", "err", err)
+			http.Error(writer, "failed to load pending build", http.StatusInternalServerError)
+			return
+		}
+		if build == nil {
+			http.Error(writer, "no build is waiting for approval", http.StatusNotFound)
+			return
+		}
+
+		writeJson(writer, http.StatusOK, build)
+	}))
+
+	mux.HandleFunc("POST /api/projects/{project}/approve", RequireRole(configuration.Etcd, RoleDeployer, func(writer http.ResponseWriter, request *http.Request) {
+		key := request.PathValue("project")
+		if !TokenFromContext(request.Context()).CanAccess(RepoFromProjectKey(key)) {
+			http.Error(writer, "project not found", http.StatusNotFound)
+			return
+		}
+
+		// The body is optional, without a version whichever build is waiting is approved
+		var approval ApprovalRequest
+		if err := json.NewDecoder(request.Body).Decode(&approval); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(writer, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		build, err := configuration.Etcd.Approve(request.Context(), key, approval.Version, approval.IgnoreWindow)
+		switch {
+		case errors.Is(err, ErrNoPendingBuild):
+			http.Error(writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrPendingVersionMismatch), errors.Is(err, ErrProjectStopped):
+			http.Error(writer, err.Error(), http.StatusConflict)
+		case err != nil:
+			slog.Error("failed to approve build", "project", key, "err", err)
+			http.Error(writer, "failed to approve build", http.StatusInternalServerError)
+		default:
+			writeJson(writer, http.StatusOK, build)
+		}
+	}))
+
+	mux.HandleFunc("GET /api/deployments", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		statuses, err := configuration.Etcd.ListDeploymentStatuses(request.Context(), "")
+		if err != nil {
+			slog.Error("failed to list deployments", "err", err)
+			http.Error(writer, "failed to list deployments", http.StatusInternalServerError)
+			return
+		}
+
+		token := TokenFromContext(request.Context())
+		writeJson(writer, http.StatusOK, slices.DeleteFunc(statuses, func(status DeploymentStatus) bool {
+			return !token.CanAccess(RepoFromProjectKey(status.Project))
+		}))
+	}))
+
+	mux.HandleFunc("GET /api/pending", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		builds, err := configuration.Etcd.ListPendingBuilds(request.Context())
+		if err != nil {
+			slog.Error("failed to list pending builds", "err", err)
+			http.Error(writer, "failed to list pending builds", http.StatusInternalServerError)
+			return
+		}
+
+		token := TokenFromContext(request.Context())
+		writeJson(writer, http.StatusOK, slices.DeleteFunc(builds, func(build PublishedBuild) bool {
+			return !token.CanAccess(RepoFromProjectKey(build.Key))
+		}))
+	}))
+
+	mux.HandleFunc("GET /api/freezes", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		freezes, err := configuration.Etcd.ListFreezes(request.Context())
+		if err != nil {
+			slog.Error("failed to list freezes", "err", err)
+			http.Error(writer, "failed to list freezes", http.StatusInternalServerError)
+			return
+		}
+
+		token := TokenFromContext(request.Context())
+		writeJson(writer, http.StatusOK, slices.DeleteFunc(freezes, func(freeze FreezeRecord) bool {
+			return !token.CanAccess(RepoFromProjectKey(freeze.Key))
+		}))
+	}))
+
+	mux.HandleFunc("GET /api/builds", viewer(func(writer http.ResponseWriter, request *http.Request) {
+		token := TokenFromContext(request.Context())
+		writeJson(writer, http.StatusOK, slices.DeleteFunc(configuration.Tracker.List(), func(record BuildRecord) bool {
+			return !token.CanAccess(record.Repo)
+		}))
+	}))
+
+	mux.HandleFunc("POST /api/builds/{id}/cancel", RequireRole(configuration.Etcd, RoleDeployer, func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+		if record, _, ok := configuration.Tracker.Get(id); !ok || !TokenFromContext(request.Context()).CanAccess(record.Repo) {
+			http.Error(writer, "build not found", http.StatusNotFound)
+			return
+		}
+
+		if !configuration.Tracker.Cancel(id) {
+			http.Error(writer, "build has already finished", http.StatusConflict)
+			return
+		}
+
+		slog.Info("cancelled build", "id", id)
+		record, _, _ := configuration.Tracker.Get(id)
+		writeJson(writer, http.StatusOK, record)
+	}))
+}
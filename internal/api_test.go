@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"context"
+	"echo-cicd/configs"
+	"encoding/json"
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestEtcd starts an embedded etcd server which is stopped when the test finishes
+func newTestEtcd(t *testing.T) *EtcdClient {
+	t.Helper()
+
+	listen, _ := url.Parse("http://127.0.0.1:0")
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*listen}
+	cfg.ListenPeerUrls = []url.URL{*listen}
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd did not start in time")
+	}
+
+	client, err := etcd.New(etcd.Config{Endpoints: []string{server.Clients[0].Addr().String()}})
+	if err != nil {
+		t.Fatalf("failed to connect to etcd: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return &EtcdClient{client: client}
+}
+
+// apiFixture is a webhook server mux backed by an embedded etcd with two projects, one of which only the scoped tokens
+// can see
+type apiFixture struct {
+	server   *httptest.Server
+	etcd     *EtcdClient
+	tracker  *BuildTracker
+	channel  chan QueuedBuild
+	admin    string
+	viewer   string
+	deployer string
+}
+
+func newApiFixture(t *testing.T) apiFixture {
+	t.Helper()
+	ctx := context.Background()
+	client := newTestEtcd(t)
+
+	for i, version := range []string{"aaaaaaa", "bbbbbbb"} {
+		for _, repo := range []string{"ryan/app", "other/app"} {
+			err := client.PublishBuild(ctx, PublishedBuild{
+				Key:       ProjectKey(repo),
+				Name:      strings.ReplaceAll(repo, "/", "-"),
+				Repo:      repo,
+				Ref:       "refs/heads/main",
+				Version:   version,
+				Timestamp: 1700000000000 + i,
+				Exec:      configs.ExecProperties{},
+			})
+			if err != nil {
+				t.Fatalf("failed to publish build: %v", err)
+			}
+		}
+	}
+
+	for _, project := range []string{"ryan__app", "other__app"} {
+		err := client.WriteDeploymentStatus(ctx, DeploymentStatus{Agent: "agent-1", Project: project, Version: "bbbbbbb", State: "running"})
+		if err != nil {
+			t.Fatalf("failed to write deployment status: %v", err)
+		}
+	}
+
+	fixture := apiFixture{etcd: client, tracker: NewBuildTracker(), channel: make(chan QueuedBuild, 10)}
+	tokens := []struct {
+		into  *string
+		role  Role
+		repos []string
+	}{
+		{&fixture.admin, RoleAdmin, []string{"*"}},
+		{&fixture.viewer, RoleViewer, []string{"ryan/*"}},
+		{&fixture.deployer, RoleDeployer, []string{"ryan/*"}},
+	}
+	for _, token := range tokens {
+		plain, _, err := client.CreateToken(ctx, string(token.role), token.role, token.repos)
+		if err != nil {
+			t.Fatalf("failed to create token: %v", err)
+		}
+		*token.into = plain
+	}
+
+	gitBaseUrl := "http://git.example.com"
+	configuration := WebhookConfiguration{Etcd: client, Tracker: fixture.tracker, GitBaseUrl: &gitBaseUrl}
+	allowedRefs := map[string][]string{"ryan/app": {"refs/heads/main"}}
+
+	mux := http.NewServeMux()
+	RegisterTriggerHandlers(mux, configuration, allowedRefs, fixture.channel)
+	RegisterApiHandlers(mux, configuration)
+	fixture.server = httptest.NewServer(mux)
+	t.Cleanup(fixture.server.Close)
+
+	return fixture
+}
+
+func (fixture apiFixture) request(t *testing.T, method string, path string, token string, body string) *http.Response {
+	t.Helper()
+
+	request, err := http.NewRequest(method, fixture.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := fixture.server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("%v %v failed: %v", method, path, err)
+	}
+	t.Cleanup(func() { _ = response.Body.Close() })
+	return response
+}
+
+func decodeResponse[T any](t *testing.T, response *http.Response) T {
+	t.Helper()
+
+	var value T
+	if err := json.NewDecoder(response.Body).Decode(&value); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return value
+}
+
+func expectStatus(t *testing.T, response *http.Response, status int) {
+	t.Helper()
+
+	if response.StatusCode != status {
+		t.Fatalf("%v %v responded with %v, expected %v", response.Request.Method, response.Request.URL.Path, response.StatusCode, status)
+	}
+}
+
+func TestApiRequiresToken(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects", "", ""), http.StatusUnauthorized)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects", "0123.nope", ""), http.StatusUnauthorized)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.viewer, `{"repo":"ryan/app"}`), http.StatusForbidden)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds/abc/cancel", fixture.viewer, ""), http.StatusForbidden)
+}
+
+func TestApiListProjects(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	response := fixture.request(t, http.MethodGet, "/api/projects", fixture.admin, "")
+	expectStatus(t, response, http.StatusOK)
+	if projects := decodeResponse[[]PublishedBuild](t, response); len(projects) != 2 {
+		t.Fatalf("admin should see both projects, got %v", projects)
+	}
+
+	response = fixture.request(t, http.MethodGet, "/api/projects", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	projects := decodeResponse[[]PublishedBuild](t, response)
+	if len(projects) != 1 || projects[0].Key != "ryan__app" {
+		t.Fatalf("viewer should only see ryan__app, got %v", projects)
+	}
+}
+
+func TestApiGetProject(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	response := fixture.request(t, http.MethodGet, "/api/projects/ryan__app", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	if project := decodeResponse[PublishedBuild](t, response); project.Version != "bbbbbbb" || project.Repo != "ryan/app" {
+		t.Fatalf("expected the latest build of ryan/app, got %+v", project)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/other__app", fixture.viewer, ""), http.StatusNotFound)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/ryan__missing", fixture.viewer, ""), http.StatusNotFound)
+}
+
+func TestApiHistory(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	response := fixture.request(t, http.MethodGet, "/api/projects/ryan__app/history", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	if history := decodeResponse[[]PublishedBuild](t, response); len(history) != 2 || history[0].Version != "bbbbbbb" {
+		t.Fatalf("expected both builds newest first, got %v", history)
+	}
+
+	response = fixture.request(t, http.MethodGet, "/api/projects/ryan__app/history?limit=1", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	if history := decodeResponse[[]PublishedBuild](t, response); len(history) != 1 || history[0].Version != "bbbbbbb" {
+		t.Fatalf("expected only the newest build, got %v", history)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/ryan__app/history?limit=0", fixture.viewer, ""), http.StatusBadRequest)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/ryan__app/history?limit=abc", fixture.viewer, ""), http.StatusBadRequest)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/other__app/history", fixture.viewer, ""), http.StatusNotFound)
+}
+
+func TestApiDeployments(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	response := fixture.request(t, http.MethodGet, "/api/deployments", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	statuses := decodeResponse[[]DeploymentStatus](t, response)
+	if len(statuses) != 1 || statuses[0].Project != "ryan__app" {
+		t.Fatalf("viewer should only see deployments of ryan__app, got %v", statuses)
+	}
+
+	response = fixture.request(t, http.MethodGet, "/api/projects/ryan__app/deployments", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	statuses = decodeResponse[[]DeploymentStatus](t, response)
+	if len(statuses) != 1 || statuses[0].Agent != "agent-1" || statuses[0].State != "running" {
+		t.Fatalf("expected the status reported by agent-1, got %v", statuses)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/other__app/deployments", fixture.viewer, ""), http.StatusNotFound)
+}
+
+func TestApiApprove(t *testing.T) {
+	fixture := newApiFixture(t)
+	ctx := context.Background()
+
+	for _, repo := range []string{"ryan/app", "other/app"} {
+		pending, err := json.Marshal(PublishedBuild{Key: ProjectKey(repo), Name: "app", Repo: repo, Version: "ccccccc"})
+		if err != nil {
+			t.Fatalf("failed to serialise pending build: %v", err)
+		}
+		if _, err = fixture.etcd.client.Put(ctx, "echocicd/pending/"+ProjectKey(repo), string(pending)); err != nil {
+			t.Fatalf("failed to write pending build: %v", err)
+		}
+	}
+
+	response := fixture.request(t, http.MethodGet, "/api/pending", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	pending := decodeResponse[[]PublishedBuild](t, response)
+	if len(pending) != 1 || pending[0].Key != "ryan__app" {
+		t.Fatalf("viewer should only see the pending build of ryan__app, got %v", pending)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/projects/ryan__app/approve", fixture.viewer, ""), http.StatusForbidden)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/projects/ryan__app/approve", fixture.deployer, `{"version":"bbb"}`), http.StatusConflict)
+
+	// Approving a stopped project fails without losing the pending build
+	if err := fixture.etcd.Undeploy(ctx, "ryan__app", false, false); err != nil {
+		t.Fatalf("failed to undeploy: %v", err)
+	}
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/projects/ryan__app/approve", fixture.deployer, ""), http.StatusConflict)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/ryan__app/pending", fixture.deployer, ""), http.StatusOK)
+
+	if err := fixture.etcd.Restore(ctx, "ryan__app"); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/projects/ryan__app/approve", fixture.deployer, `{"version":"ccc"}`), http.StatusOK)
+	expectStatus(t, fixture.request(t, http.MethodGet, "/api/projects/ryan__app/pending", fixture.deployer, ""), http.StatusNotFound)
+
+	response = fixture.request(t, http.MethodGet, "/api/projects/ryan__app", fixture.deployer, "")
+	expectStatus(t, response, http.StatusOK)
+	if build := decodeResponse[PublishedBuild](t, response); build.Version != "ccccccc" || build.Retired != 0 {
+		t.Fatalf("expected the approved build to be published, got %+v", build)
+	}
+}
+
+func TestApiFreezes(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	for _, project := range []string{"ryan__app", "other__app"} {
+		if err := fixture.etcd.Freeze(context.Background(), project, "incident"); err != nil {
+			t.Fatalf("failed to freeze %v: %v", project, err)
+		}
+	}
+
+	response := fixture.request(t, http.MethodGet, "/api/freezes", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	freezes := decodeResponse[[]FreezeRecord](t, response)
+	if len(freezes) != 1 || freezes[0].Key != "ryan__app" || freezes[0].Reason != "incident" {
+		t.Fatalf("viewer should only see the freeze on ryan__app, got %v", freezes)
+	}
+
+	response = fixture.request(t, http.MethodGet, "/api/freezes", fixture.admin, "")
+	expectStatus(t, response, http.StatusOK)
+	if freezes = decodeResponse[[]FreezeRecord](t, response); len(freezes) != 2 {
+		t.Fatalf("admin should see both freezes, got %v", freezes)
+	}
+}
+
+func TestApiTrigger(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	response := fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `{"repo":"ryan/app","ref":"refs/heads/main","commit":"abc123"}`)
+	expectStatus(t, response, http.StatusAccepted)
+	record := decodeResponse[BuildRecord](t, response)
+	if record.Status != BuildQueued || record.Repo != "ryan/app" || record.Commit != "abc123" {
+		t.Fatalf("expected a queued build of ryan/app, got %+v", record)
+	}
+
+	select {
+	case queued := <-fixture.channel:
+		if queued.Id != record.Id || queued.Request.Repository.CloneUrl != "http://git.example.com/ryan/app.git" {
+			t.Fatalf("unexpected build was queued: %+v", queued)
+		}
+	default:
+		t.Fatal("build was not queued")
+	}
+
+	response = fixture.request(t, http.MethodGet, "/api/builds/"+record.Id, fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	if fetched := decodeResponse[BuildRecord](t, response); fetched.Id != record.Id {
+		t.Fatalf("expected build %v, got %+v", record.Id, fetched)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `{"repo":"other/app","ref":"refs/heads/main"}`), http.StatusForbidden)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `{"repo":"ryan/app","ref":"refs/heads/feature"}`), http.StatusForbidden)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `{"repo":"ryan/app","ref":"refs/heads/main","clone_url":"http://evil.example.com/other/app.git"}`), http.StatusForbidden)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `{"ref":"refs/heads/main"}`), http.StatusBadRequest)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds", fixture.deployer, `not json`), http.StatusBadRequest)
+	if len(fixture.channel) != 0 {
+		t.Fatal("rejected triggers should not queue builds")
+	}
+}
+
+func TestApiCancel(t *testing.T) {
+	fixture := newApiFixture(t)
+
+	ours := fixture.tracker.Enqueue(BuildRequest{Repository: Repository{FullName: "ryan/app"}, Ref: "refs/heads/main"})
+	theirs := fixture.tracker.Enqueue(BuildRequest{Repository: Repository{FullName: "other/app"}, Ref: "refs/heads/main"})
+
+	response := fixture.request(t, http.MethodPost, "/api/builds/"+ours.Id+"/cancel", fixture.deployer, "")
+	expectStatus(t, response, http.StatusOK)
+	if record := decodeResponse[BuildRecord](t, response); record.Status != BuildCancelled {
+		t.Fatalf("expected the build to be cancelled, got %+v", record)
+	}
+
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds/"+ours.Id+"/cancel", fixture.deployer, ""), http.StatusConflict)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds/"+theirs.Id+"/cancel", fixture.deployer, ""), http.StatusNotFound)
+	expectStatus(t, fixture.request(t, http.MethodPost, "/api/builds/missing/cancel", fixture.deployer, ""), http.StatusNotFound)
+
+	response = fixture.request(t, http.MethodGet, "/api/builds", fixture.viewer, "")
+	expectStatus(t, response, http.StatusOK)
+	if records := decodeResponse[[]BuildRecord](t, response); len(records) != 1 || records[0].Id != ours.Id {
+		t.Fatalf("viewer should only see builds of ryan/app, got %v", records)
+	}
+}
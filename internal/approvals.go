@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	etcd "go.etcd.io/etcd/client/v3"
+	"log/slog"
+	"strings"
+)
+
+// ErrNoPendingBuild is returned when approving a project which has no build waiting for approval
+var ErrNoPendingBuild = errors.New("no build is waiting for approval")
+
+// ErrPendingVersionMismatch is returned when the build waiting for approval is not the version being approved
+var ErrPendingVersionMismatch = errors.New("the build waiting for approval is a different version")
+
+// GetPendingBuild returns the build of a project waiting for approval, or nil if there isn't one
+func (client *EtcdClient) GetPendingBuild(ctx context.Context, key string) (*PublishedBuild, error) {
+	build, _, err := client.getPendingBuild(ctx, key)
+	return build, err
+}
+
+func (client *EtcdClient) getPendingBuild(ctx context.Context, key string) (*PublishedBuild, int64, error) {
+	entries, err := client.client.Get(ctx, "echocicd/pending/"+key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query for pending build: %w", err)
+	}
+	if len(entries.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	var build PublishedBuild
+	err = json.Unmarshal(entries.Kvs[0].Value, &build)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse pending build of %v: %w", key, err)
+	}
+	return &build, entries.Kvs[0].ModRevision, nil
+}
+
+// ListPendingBuilds returns the build waiting for approval of every project which has one
+func (client *EtcdClient) ListPendingBuilds(ctx context.Context) ([]PublishedBuild, error) {
+	entries, err := client.client.Get(ctx, "echocicd/pending/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for pending builds: %w", err)
+	}
+
+	result := make([]PublishedBuild, 0, len(entries.Kvs))
+	for _, kv := range entries.Kvs {
+		var build PublishedBuild
+		err = json.Unmarshal(kv.Value, &build)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pending build %v: %w", string(kv.Key), err)
+		}
+		result = append(result, build)
+	}
+
+	return result, nil
+}
+
+// Approve publishes the build of a project waiting for approval so agents deploy it. If version is set, which may be
+// shortened, the pending build must be that version so a newer build is never approved by mistake. If ignoreWindow is
+// set the build is deployed straight away even outside of its deploy window
+func (client *EtcdClient) Approve(ctx context.Context, key string, version string, ignoreWindow bool) (*PublishedBuild, error) {
+	build, revision, err := client.getPendingBuild(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if build == nil {
+		return nil, ErrNoPendingBuild
+	}
+	if version != "" && !strings.HasPrefix(build.Version, version) {
+		return nil, fmt.Errorf("%w: %v is waiting, not %v", ErrPendingVersionMismatch, build.Version, version)
+	}
+
+	build.IgnoreWindow = build.IgnoreWindow || ignoreWindow
+	ops, err := publishOps(*build)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pending build is removed in the same transaction which publishes it, so a build which is replaced while it is
+	// being approved or approved twice at once is never published, and a failed publish leaves it waiting
+	pendingKey := "echocicd/pending/" + key
+	response, err := client.client.Txn(ctx).
+		If(etcd.Compare(etcd.ModRevision(pendingKey), "=", revision), notStopped(key)).
+		Then(append([]etcd.Op{etcd.OpDelete(pendingKey)}, ops...)...).
+		Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish approved build: %w", err)
+	}
+	if !response.Succeeded {
+		stopped, err := client.IsStopped(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if stopped {
+			return nil, fmt.Errorf("%w: %v", ErrProjectStopped, key)
+		}
+		return nil, fmt.Errorf("the build waiting for approval of %v changed, check it and approve again", key)
+	}
+
+	slog.Info("approved build", "key", key, "version", build.Version)
+	return build, nil
+}
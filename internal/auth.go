@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	etcd "go.etcd.io/etcd/client/v3"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("token is invalid or has been revoked")
+
+// TokenCookie is checked for a token on read-only requests, so the dashboard can authenticate its event stream
+const TokenCookie = "echocicd_token"
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleDeployer Role = "deployer"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:   1,
+	RoleDeployer: 2,
+	RoleAdmin:    3,
+}
+
+func ParseRole(value string) (Role, error) {
+	role := Role(value)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, expected viewer, deployer or admin", value)
+	}
+	return role, nil
+}
+
+// Allows returns true if this role grants at least the permissions of the required role
+func (role Role) Allows(required Role) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// ApiToken is the record stored in etcd for each token. Only the sha256 of the token is kept
+type ApiToken struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Hash    string   `json:"hash"`
+	Role    Role     `json:"role"`
+	Repos   []string `json:"repos"`
+	Created int64    `json:"created"`
+}
+
+// CanAccess returns true if the repo matches one of the globs the token is scoped to. A glob of * matches every repo,
+// otherwise globs are matched with path.Match so ryan/* matches every repo owned by ryan
+func (token ApiToken) CanAccess(repo string) bool {
+	return slices.ContainsFunc(token.Repos, func(glob string) bool {
+		if glob == "*" {
+			return true
+		}
+		matched, err := path.Match(glob, repo)
+		return err == nil && matched
+	})
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken stores a new token and returns the plain text value, which cannot be recovered later
+func (client *EtcdClient) CreateToken(ctx context.Context, name string, role Role, repos []string) (string, *ApiToken, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token id: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token secret: %w", err)
+	}
+
+	token := &ApiToken{
+		Id:      hex.EncodeToString(id),
+		Name:    name,
+		Role:    role,
+		Repos:   repos,
+		Created: time.Now().UnixMilli(),
+	}
+	plain := token.Id + "." + hex.EncodeToString(secret)
+	token.Hash = hashToken(plain)
+
+	j, err := json.Marshal(token)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to serialise token: %w", err)
+	}
+
+	_, err = client.client.Put(ctx, "echocicd/auth/tokens/"+token.Id, string(j))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store token: %w", err)
+	}
+
+	return plain, token, nil
+}
+
+func (client *EtcdClient) RevokeToken(ctx context.Context, id string) error {
+	response, err := client.client.Delete(ctx, "echocicd/auth/tokens/"+id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if response.Deleted == 0 {
+		return fmt.Errorf("no token with id %v", id)
+	}
+	return nil
+}
+
+func (client *EtcdClient) ListTokens(ctx context.Context) ([]ApiToken, error) {
+	entries, err := client.client.Get(ctx, "echocicd/auth/tokens/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for tokens: %w", err)
+	}
+
+	result := make([]ApiToken, 0, len(entries.Kvs))
+	for _, kv := range entries.Kvs {
+		var token ApiToken
+		err = json.Unmarshal(kv.Value, &token)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token %v: %w", string(kv.Key), err)
+		}
+		result = append(result, token)
+	}
+
+	return result, nil
+}
+
+// Authenticate looks up the token by the id embedded in it and checks it against the stored hash
+func (client *EtcdClient) Authenticate(ctx context.Context, plain string) (*ApiToken, error) {
+	id, _, ok := strings.Cut(plain, ".")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return nil, ErrInvalidToken
+	}
+
+	entries, err := client.client.Get(ctx, "echocicd/auth/tokens/"+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for token: %w", err)
+	}
+	if len(entries.Kvs) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	var token ApiToken
+	err = json.Unmarshal(entries.Kvs[0].Value, &token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(plain)), []byte(token.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	return &token, nil
+}
+
+type tokenContextKey struct{}
+
+// TokenFromContext returns the token that authenticated the request, as stored by RequireRole
+func TokenFromContext(ctx context.Context) ApiToken {
+	token, _ := ctx.Value(tokenContextKey{}).(ApiToken)
+	return token
+}
+
+// RequireRole wraps a handler so that it is only called for requests carrying a token with at least the given role.
+// Tokens are read from the Authorization header, or for GET requests only, from the token cookie
+func RequireRole(client *EtcdClient, role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		plain, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok && request.Method == http.MethodGet {
+			if cookie, err := request.Cookie(TokenCookie); err == nil {
+				plain, ok = cookie.Value, true
+			}
+		}
+		if !ok {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := client.Authenticate(request.Context(), plain)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidToken) {
+				http.Error(writer, "failed to authenticate", http.StatusInternalServerError)
+				return
+			}
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !token.Role.Allows(role) {
+			http.Error(writer, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler(writer, request.WithContext(context.WithValue(request.Context(), tokenContextKey{}, *token)))
+	}
+}
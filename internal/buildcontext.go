@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/moby/patternmatcher"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Values accepted by [builder] precedence, deciding what happens when the builder and project contain the same file
+const (
+	PrecedenceError   = "error"
+	PrecedenceBuilder = "builder"
+	PrecedenceProject = "project"
+)
+
+// ConflictError is returned when builder files collide with project files and no precedence was configured
+type ConflictError struct {
+	Paths []string
+}
+
+func (err ConflictError) Error() string {
+	return fmt.Sprintf("builder files conflict with files in the project: %v - rename them, exclude them, or set [builder] precedence to %q or %q", strings.Join(err.Paths, ", "), PrecedenceBuilder, PrecedenceProject)
+}
+
+// ListBuilderFiles maps the path of every file in the builder relative to its root to its path on disk, skipping the
+// builder's ignore file which is merged into the generated one instead, and its manifest
+func ListBuilderFiles(builderDir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(builderDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(builderDir, file)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+
+		if relative != ".dockerignore" && relative != BuilderManifestFile {
+			files[relative] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list builder files: %w", err)
+	}
+
+	return files, nil
+}
+
+// BuildContext streams a tar of the project with the overlay files (usually from a builder, keyed by their path in
+// the context) layered over it and the merged ignore rules written as its .dockerignore, without modifying anything on
+// disk. Conflicting paths are resolved according to precedence, which defaults to returning a ConflictError
+func BuildContext(workingDir string, overlay map[string]string, excludes []string, precedence string) (io.ReadCloser, error) {
+	if precedence == "" {
+		precedence = PrecedenceError
+	}
+	if !slices.Contains([]string{PrecedenceError, PrecedenceBuilder, PrecedenceProject}, precedence) {
+		return nil, fmt.Errorf("unknown precedence %q, expected %v, %v or %v", precedence, PrecedenceError, PrecedenceBuilder, PrecedenceProject)
+	}
+
+	matcher, err := patternmatcher.New(excludes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore patterns: %w", err)
+	}
+
+	overlay = maps.Clone(overlay)
+
+	// A conflict is only a problem if the project file would actually make it into the context
+	conflicts := make([]string, 0)
+	for file := range overlay {
+		stat, err := os.Lstat(filepath.Join(workingDir, filepath.FromSlash(file)))
+		if err != nil || stat.IsDir() {
+			continue
+		}
+
+		ignored, err := matcher.MatchesOrParentMatches(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to match ignore patterns: %w", err)
+		}
+		if !ignored {
+			conflicts = append(conflicts, file)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		slices.Sort(conflicts)
+		switch precedence {
+		case PrecedenceError:
+			return nil, ConflictError{Paths: conflicts}
+		case PrecedenceProject:
+			slog.Info("project files take precedence over builder files", "paths", conflicts)
+			for _, file := range conflicts {
+				delete(overlay, file)
+			}
+		case PrecedenceBuilder:
+			slog.Info("builder files take precedence over project files", "paths", conflicts)
+		}
+	}
+
+	project, err := archive.TarWithOptions(workingDir, &archive.TarOptions{ExcludePatterns: excludes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to tar working directory: %w", err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer project.Close()
+		err := writeBuildContext(writer, project, overlay, excludes)
+		_ = writer.CloseWithError(err)
+	}()
+
+	return reader, nil
+}
+
+func writeBuildContext(output io.Writer, project io.Reader, overlay map[string]string, excludes []string) error {
+	writer := tar.NewWriter(output)
+
+	// Copy the project across, dropping anything the builder replaces and the project's own ignore file
+	projectReader := tar.NewReader(project)
+	for {
+		header, err := projectReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read project archive: %w", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean(header.Name), "./")
+		if _, replaced := overlay[name]; replaced || name == ".dockerignore" {
+			continue
+		}
+
+		if err = writer.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write build context: %w", err)
+		}
+		if _, err = io.Copy(writer, projectReader); err != nil {
+			return fmt.Errorf("failed to write build context: %w", err)
+		}
+	}
+
+	files := make([]string, 0, len(overlay))
+	for file := range overlay {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	for _, file := range files {
+		if err := writeOverlayFile(writer, file, overlay[file]); err != nil {
+			return err
+		}
+	}
+
+	ignore := []byte(strings.Join(excludes, "\n") + "\n")
+	err := writer.WriteHeader(&tar.Header{
+		Name:    ".dockerignore",
+		Mode:    0644,
+		Size:    int64(len(ignore)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write build context: %w", err)
+	}
+	if _, err = writer.Write(ignore); err != nil {
+		return fmt.Errorf("failed to write build context: %w", err)
+	}
+
+	return writer.Close()
+}
+
+func writeOverlayFile(writer *tar.Writer, file string, source string) error {
+	stat, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("failed to read builder file %v: %w", file, err)
+	}
+
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return fmt.Errorf("failed to create header for builder file %v: %w", file, err)
+	}
+	header.Name = file
+
+	handle, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to read builder file %v: %w", file, err)
+	}
+	defer handle.Close()
+
+	if err = writer.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write build context: %w", err)
+	}
+	if _, err = io.Copy(writer, handle); err != nil {
+		return fmt.Errorf("failed to write build context: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("failed to create directory for %v: %v", name, err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+	}
+}
+
+// readContext reads every file out of a build context, keyed by its path
+func readContext(t *testing.T, context io.ReadCloser) map[string]string {
+	t.Helper()
+	defer context.Close()
+
+	files := map[string]string{}
+	reader := tar.NewReader(context)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("failed to read build context: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("failed to read %v from build context: %v", header.Name, err)
+		}
+		files[strings.TrimPrefix(header.Name, "./")] = string(content)
+	}
+}
+
+func TestBuildContextIgnoreRules(t *testing.T) {
+	project, builder := t.TempDir(), t.TempDir()
+	writeFiles(t, project, map[string]string{
+		".dockerignore":       "node_modules\n**/*.log\n",
+		"main.go":             "package main",
+		"README.md":           "# readme",
+		"keep.log":            "kept by an exception",
+		"logs/app.log":        "ignored by the project",
+		"node_modules/dep.js": "ignored by the project",
+		"secrets/key.pem":     "ignored by the builder",
+	})
+	writeFiles(t, builder, map[string]string{
+		".dockerignore": "secrets\n",
+		"Dockerfile":    "FROM scratch",
+		"build.sh":      "#!/bin/sh",
+	})
+
+	excludes, err := BuildIgnorePatterns(project, builder, []string{"README.md", "!keep.log"}, "Dockerfile")
+	if err != nil {
+		t.Fatalf("failed to merge ignore rules: %v", err)
+	}
+
+	overlay, err := ListBuilderFiles(builder)
+	if err != nil {
+		t.Fatalf("failed to list builder files: %v", err)
+	}
+
+	context, err := BuildContext(project, overlay, excludes, "")
+	if err != nil {
+		t.Fatalf("failed to create build context: %v", err)
+	}
+	files := readContext(t, context)
+
+	for _, present := range []string{"main.go", "keep.log", "Dockerfile", "build.sh", ".dockerignore"} {
+		if _, ok := files[present]; !ok {
+			t.Errorf("expected %v in the build context", present)
+		}
+	}
+	for _, absent := range []string{"README.md", "logs/app.log", "node_modules/dep.js", "secrets/key.pem"} {
+		if _, ok := files[absent]; ok {
+			t.Errorf("expected %v to be left out of the build context", absent)
+		}
+	}
+
+	// The ignore file sent to the daemon is the merged rules rather than the project's own
+	rules := strings.Split(strings.TrimSpace(files[".dockerignore"]), "\n")
+	if !slices.Equal(rules, excludes) {
+		t.Errorf("expected the merged rules %v in .dockerignore, got %v", excludes, rules)
+	}
+}
@@ -3,6 +3,9 @@ package internal
 import (
 	"bufio"
 	"context"
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
 	"echo-cicd/configs"
 	"echo-cicd/util"
 	"encoding/json"
@@ -10,17 +13,23 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types"
 	docker "github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
 	"github.com/go-git/go-git/v5"
-	"github.com/plus3it/gorecurcopy"
+	"github.com/moby/patternmatcher/ignorefile"
 	"github.com/xeipuuv/gojsonschema"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
+// DefaultBuildTimeout is used when a deploy config does not specify a [builder] timeout
+const DefaultBuildTimeout = 30 * time.Minute
+
 type ErrorLine struct {
 	Error       string      `json:"error"`
 	ErrorDetail ErrorDetail `json:"errorDetail"`
@@ -30,21 +39,33 @@ type ErrorDetail struct {
 	Message string `json:"message"`
 }
 
-func BuildInDir(directory string, expectedFileName string, buildersDir string, conn *docker.Client, registry *string, auth *string, etcd *EtcdClient) error {
+func BuildInDir(ctx context.Context, directory string, expectedFileName string, buildersDir string, conn *docker.Client, registry *string, auths *RegistryAuths, etcd *EtcdClient, output io.Writer) error {
 	config, err := configs.LoadDeployConfigFromFile(path.Join(directory, expectedFileName))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			slog.Error("failed to process deploy config - file could not be found")
 		} else {
-			slog.Error("failed to process deploy config - error loading file: %w", err)
+			slog.Error("failed to process deploy config - error loading file", "err", err)
 		}
 		return err
 	}
 
-	return BuildFromConfig(*config, buildersDir, directory, conn, registry, auth, etcd)
+	return BuildFromConfig(ctx, *config, buildersDir, directory, conn, registry, auths, etcd, output)
 }
 
-func BuildFromConfig(config configs.DeployConfig, buildersDir string, workingDir string, conn *docker.Client, registry *string, auth *string, etcd *EtcdClient) error {
+func BuildFromConfig(ctx context.Context, config configs.DeployConfig, buildersDir string, workingDir string, conn *docker.Client, registry *string, auths *RegistryAuths, etcd *EtcdClient, output io.Writer) error {
+	// The config may have been changed since it was loaded, ie by arg overrides, so check it again before building
+	if problems := config.Validate(); len(problems) > 0 {
+		return configs.ValidationError{Problems: problems}
+	}
+
+	timeout := config.Builder.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBuildTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	// Make sure this is a git repo so we can use a hash for identification
 	repo, err := git.PlainOpen(workingDir)
 	if err != nil {
@@ -57,70 +78,27 @@ func BuildFromConfig(config configs.DeployConfig, buildersDir string, workingDir
 	}
 
 	hash := head.Hash().String()
-
-	// Check the builder exists
-	builderDir := path.Join(buildersDir, config.Builder.Id)
-	slog.Info("looking for builder", "path", builderDir, "id", config.Builder.Id)
-	stat, err := os.Stat(builderDir)
-	if err != nil {
-		return fmt.Errorf("the builder could not be loaded by id: %w", err)
-	}
-
-	if !stat.IsDir() {
-		return fmt.Errorf("the builder was invalid, expected dir")
-	}
-	// Load the CUE file from the builder if its present
-	//   Validate the args in the config
-	if err = ValidateArgsIfPresent(config, builderDir, config.Builder.Args); err != nil {
-		return fmt.Errorf("failed to validate args: %w", err)
+	ref := config.Ref
+	if ref == "" {
+		ref = head.Name().String()
 	}
 
-	// Read .dockerignore from the project, in case we replace it now
-	var existingIgnoreContent *string = nil
-	existingIgnoreBytes, err := os.ReadFile(path.Join(workingDir, ".dockerignore"))
+	source, err := ResolveBuildSource(config, buildersDir, workingDir)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return fmt.Errorf("could not create ignore file: %w", err)
-		}
-	} else {
-		v := string(existingIgnoreBytes)
-		existingIgnoreContent = &v
-	}
-
-	// Copy files from the builder into the working directory
-	dir, err := os.ReadDir(builderDir)
-	if err != nil {
-		return fmt.Errorf("failed to load directory listing: %w", err)
-	}
-
-	for _, entry := range dir {
-		err = nil
-		if entry.IsDir() {
-			err = gorecurcopy.CopyDirectory(path.Join(builderDir, entry.Name()), path.Join(workingDir, entry.Name()))
-		} else {
-			err = gorecurcopy.Copy(path.Join(builderDir, entry.Name()), path.Join(workingDir, entry.Name()))
-		}
-
-		if err != nil {
-			return fmt.Errorf("failed to copy from builder to working dir: %w", err)
-		}
+		return err
 	}
 
-	// Create .dockerignore file based on the config, merging values if required
-	ignoreFile, err := os.OpenFile(path.Join(workingDir, ".dockerignore"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	excludes, err := BuildIgnorePatterns(source.ContextDir, source.BuilderDir, config.Builder.Exclude, source.Dockerfile)
 	if err != nil {
-		return fmt.Errorf("failed to create new dockerignore file: %w", err)
-	}
-
-	compiledIgnore := "\n\n"
-	if existingIgnoreContent != nil {
-		compiledIgnore += *existingIgnoreContent
+		return err
 	}
 
-	_, err = ignoreFile.Write([]byte(compiledIgnore))
+	// Layer the builder over the project in memory so the working directory is never modified
+	buildContext, err := BuildContext(source.ContextDir, source.Overlay, excludes, config.Builder.Precedence)
 	if err != nil {
-		return fmt.Errorf("failed to write to dockerignore: %w", err)
+		return err
 	}
+	defer buildContext.Close()
 
 	// Run docker build
 
@@ -131,38 +109,71 @@ func BuildFromConfig(config configs.DeployConfig, buildersDir string, workingDir
 	tag += config.Global.Name
 	slog.Info("tag prepared", "tag", tag)
 
-	content, err := json.Marshal(config.Builder.Args)
+	content, err := json.Marshal(source.Args)
 	if err != nil {
 		return fmt.Errorf("failed to marshall builder args: %w", err)
 	}
 	contentAsString := string(content)
 
-	err = BuildImage(conn, workingDir, tag, hash, contentAsString)
+	labels := maps.Clone(config.Builder.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["echocicd.name"] = config.Global.Name
+	labels["echocicd.repo"] = config.Global.Repo
+	labels["echocicd.commit"] = hash
+	if config.Environment != "" {
+		labels["echocicd.environment"] = config.Environment
+	}
+
+	err = BuildImage(ctx, conn, buildContext, ImageSpec{
+		Dockerfile: source.Dockerfile,
+		Target:     config.Builder.Target,
+		Platform:   config.Builder.Platform,
+		Tag:        tag,
+		Hash:       hash,
+		Args:       contentAsString,
+		Labels:     labels,
+	}, output)
 	if err != nil {
 		return fmt.Errorf("failed to build image: %w", err)
 	}
 
+	digest := ""
 	if registry != nil {
-		authReal := ""
-		if auth != nil {
-			authReal = *auth
-		} else {
-			if v, ok := os.LookupEnv("PUSH_AUTH"); ok {
-				authReal = v
-			}
+		auth, err := auths.For(tag)
+		if err != nil {
+			return fmt.Errorf("failed to resolve registry credentials: %w", err)
 		}
 
-		response, err := conn.ImagePush(context.Background(), tag, types.ImagePushOptions{
-			RegistryAuth: authReal,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to push image to registry: %w", err)
+		// Push every tag that was built so :latest in the registry tracks the most recent build. The digest is taken
+		// from the commit tag as that is the one that gets deployed
+		for _, pushTag := range []string{tag + ":" + hash, tag + ":latest"} {
+			pushDigest := ""
+			err = RetryRegistry(ctx, "push "+pushTag, func() error {
+				response, err := conn.ImagePush(ctx, pushTag, types.ImagePushOptions{
+					RegistryAuth: auth,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to push image %v to registry: %w", pushTag, err)
+				}
+
+				pushDigest, err = ScanForPushDigest(response, output)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			if digest == "" {
+				digest = pushDigest
+			}
 		}
 
-		err = ScanForDockerError(response)
-		if err != nil {
-			return err
+		if digest == "" {
+			return fmt.Errorf("registry did not report a digest for %v", tag+":"+hash)
 		}
+		slog.Info("pushed image", "tag", tag, "digest", digest)
 	}
 
 	rv := ""
@@ -170,14 +181,40 @@ func BuildFromConfig(config configs.DeployConfig, buildersDir string, workingDir
 		rv = *registry
 	}
 
-	err = etcd.WriteBuildInfo(config.Global.Repo, config.Global.Name, hash, tag+":"+hash, rv, config.Exec)
+	err = etcd.WriteBuildInfo(config.Global.Repo, config.Environment, ref, config.Global.Name, hash, tag+":"+hash, digest, rv, config.Exec, config.IgnoreWindow)
 	if err != nil {
 		return fmt.Errorf("failed to write details to etcd: %w", err)
 	}
 
 	return nil
 }
-func ScanForDockerError(reader io.ReadCloser) error {
+
+// PushLine is the subset of a line of push output that reports the digest of the pushed manifest
+type PushLine struct {
+	Aux struct {
+		Tag    string `json:"Tag"`
+		Digest string `json:"Digest"`
+	} `json:"aux"`
+}
+
+func ScanForDockerError(reader io.ReadCloser, output io.Writer) error {
+	return scanDockerOutput(reader, output, nil)
+}
+
+// ScanForPushDigest behaves like ScanForDockerError but also returns the manifest digest reported by the push
+func ScanForPushDigest(reader io.ReadCloser, output io.Writer) (string, error) {
+	digest := ""
+	err := scanDockerOutput(reader, output, func(line string) {
+		var pushLine PushLine
+		if json.Unmarshal([]byte(line), &pushLine) == nil && pushLine.Aux.Digest != "" {
+			digest = pushLine.Aux.Digest
+		}
+	})
+
+	return digest, err
+}
+
+func scanDockerOutput(reader io.ReadCloser, output io.Writer, handler func(line string)) error {
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
@@ -190,7 +227,15 @@ func ScanForDockerError(reader io.ReadCloser) error {
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		lastLine = scanner.Text()
-		fmt.Println(scanner.Text())
+		_, _ = fmt.Fprintln(output, scanner.Text())
+		if handler != nil {
+			handler(lastLine)
+		}
+	}
+
+	// Check the scanner first, a cancelled build will cut the stream off part way through a line
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan: %w", err)
 	}
 
 	errLine := &ErrorLine{}
@@ -202,37 +247,36 @@ func ScanForDockerError(reader io.ReadCloser) error {
 		return fmt.Errorf("failed: %w", errors.New(errLine.Error))
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to scan: %w", err)
-	}
-
 	return nil
 }
 
-func BuildImage(conn *docker.Client, workingDir string, tag string, hash string, argsAsString string) error {
-	tar, err := archive.TarWithOptions(workingDir, &archive.TarOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to tar working directory: %w", err)
-	}
-	defer func(tar io.ReadCloser) {
-		err := tar.Close()
-		if err != nil {
-			slog.Error("failed to close tar", "err", err)
-		}
-	}(tar)
+// ImageSpec describes the image BuildImage should produce from a build context
+type ImageSpec struct {
+	Dockerfile string
+	Target     string
+	Platform   string
+	Tag        string
+	Hash       string
+	Args       string
+	Labels     map[string]string
+}
 
-	response, err := conn.ImageBuild(context.Background(), tar, types.ImageBuildOptions{
-		Dockerfile: "Dockerfile",
-		Tags:       []string{tag + ":" + hash, tag + ":latest"},
+func BuildImage(ctx context.Context, conn *docker.Client, buildContext io.Reader, spec ImageSpec, output io.Writer) error {
+	response, err := conn.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Dockerfile: spec.Dockerfile,
+		Target:     spec.Target,
+		Platform:   spec.Platform,
+		Tags:       []string{spec.Tag + ":" + spec.Hash, spec.Tag + ":latest"},
 		BuildArgs: map[string]*string{
-			"BUILDER_ARGS": &argsAsString,
+			"BUILDER_ARGS": &spec.Args,
 		},
+		Labels: spec.Labels,
 		Remove: true,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to build image: %w", err)
 	}
-	err = ScanForDockerError(response.Body)
+	err = ScanForDockerError(response.Body, output)
 	if err != nil {
 		return err
 	}
@@ -240,7 +284,178 @@ func BuildImage(conn *docker.Client, workingDir string, tag string, hash string,
 	return nil
 }
 
-func ValidateArgsIfPresent(config configs.DeployConfig, builderDir string, args map[string]interface{}) error {
+// BuildIgnorePatterns merges the project's .dockerignore, the builder's .dockerignore (if there is a builder) and the
+// exclude entries from the deploy config, in that order so later rules (including ! exceptions) take precedence
+func BuildIgnorePatterns(workingDir string, builderDir string, exclude []string, dockerfile string) ([]string, error) {
+	projectRules, err := ReadIgnoreFile(path.Join(workingDir, ".dockerignore"))
+	if err != nil {
+		return nil, err
+	}
+
+	var builderRules []string
+	if builderDir != "" {
+		builderRules, err = ReadIgnoreFile(path.Join(builderDir, ".dockerignore"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	configRules, err := ignorefile.ReadAll(strings.NewReader(strings.Join(exclude, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude entry: %w", err)
+	}
+
+	patterns := slices.Concat(projectRules, builderRules, configRules)
+
+	// Like the docker cli, the Dockerfile and ignore file are always sent so the daemon can use them
+	if len(patterns) > 0 {
+		patterns = append(patterns, "!"+dockerfile, "!.dockerignore")
+	}
+
+	return patterns, nil
+}
+
+// ReadIgnoreFile returns the patterns in a .dockerignore file, or nothing if the file does not exist
+func ReadIgnoreFile(file string) ([]string, error) {
+	handle, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read ignore file %v: %w", file, err)
+	}
+	defer handle.Close()
+
+	patterns, err := ignorefile.ReadAll(handle)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ignore file %v: %w", file, err)
+	}
+
+	return patterns, nil
+}
+
+// BuildSource is where the build context and Dockerfile come from, either a builder overlaid on the repository or a
+// Dockerfile that lives in the repository itself
+type BuildSource struct {
+	// ContextDir is the directory sent as the build context
+	ContextDir string
+	// BuilderDir is empty when building from a Dockerfile in the repository
+	BuilderDir string
+	// Overlay maps paths in the build context to files on disk which are layered over ContextDir
+	Overlay map[string]string
+	// Dockerfile is the path of the Dockerfile within the build context
+	Dockerfile string
+	// Args are the builder args from the deploy config with any defaults from the builder manifest applied
+	Args map[string]interface{}
+}
+
+// inlineDockerfile is the name used for a repository Dockerfile that lives outside the build context, in the same way
+// the docker cli sends one
+const inlineDockerfile = ".echocicd.Dockerfile"
+
+// ResolveBuildSource works out what to build from the [builder] section, which must contain either an id or a
+// dockerfile
+func ResolveBuildSource(config configs.DeployConfig, buildersDir string, workingDir string) (*BuildSource, error) {
+	if config.Builder.Id != "" && config.Builder.Dockerfile != "" {
+		return nil, errors.New("the builder section can only specify one of id or dockerfile")
+	}
+
+	if config.Builder.Dockerfile != "" {
+		contextDir, err := resolveInRepo(workingDir, config.Builder.Context)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build context: %w", err)
+		}
+
+		dockerfile, err := resolveInRepo(workingDir, config.Builder.Dockerfile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dockerfile: %w", err)
+		}
+
+		stat, err := os.Stat(dockerfile)
+		if err != nil {
+			return nil, fmt.Errorf("the dockerfile could not be loaded: %w", err)
+		}
+		if stat.IsDir() {
+			return nil, fmt.Errorf("the dockerfile %v is a directory", config.Builder.Dockerfile)
+		}
+
+		source := &BuildSource{ContextDir: contextDir, Overlay: map[string]string{}, Args: config.Builder.Args}
+		relative, err := filepath.Rel(contextDir, dockerfile)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+			source.Dockerfile = inlineDockerfile
+			source.Overlay[inlineDockerfile] = dockerfile
+		} else {
+			source.Dockerfile = filepath.ToSlash(relative)
+		}
+
+		slog.Info("building from repository dockerfile", "dockerfile", config.Builder.Dockerfile, "context", config.Builder.Context)
+		return source, nil
+	}
+
+	if config.Builder.Id == "" {
+		return nil, errors.New("the builder section must specify either an id or a dockerfile")
+	}
+
+	builder, err := ResolveBuilder(buildersDir, config.Builder.Id)
+	if err != nil {
+		return nil, fmt.Errorf("the builder could not be loaded by id: %w", err)
+	}
+	builderDir := builder.Dir
+	slog.Info("resolved builder", "path", builderDir, "id", config.Builder.Id, "version", builder.Manifest.Version)
+
+	if config.Builder.Platform != "" && len(builder.Manifest.Platforms) > 0 && !slices.Contains(builder.Manifest.Platforms, config.Builder.Platform) {
+		return nil, fmt.Errorf("builder %v@%v does not support platform %v, supported platforms are: %v", builder.Manifest.Name, builder.Manifest.Version, config.Builder.Platform, strings.Join(builder.Manifest.Platforms, ", "))
+	}
+
+	args, err := ApplyManifestArgs(builder.Manifest, config.Builder.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unify the args with the builder's CUE schema first so its defaults are filled in before the JSON schema runs
+	args, err = UnifyArgsWithCueIfPresent(builderDir, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate args: %w", err)
+	}
+	if err = ValidateArgsIfPresent(builderDir, args); err != nil {
+		return nil, fmt.Errorf("failed to validate args: %w", err)
+	}
+
+	overlay, err := ListBuilderFiles(builderDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BuildSource{
+		ContextDir: workingDir,
+		BuilderDir: builderDir,
+		Overlay:    overlay,
+		Dockerfile: "Dockerfile",
+		Args:       args,
+	}, nil
+}
+
+// resolveInRepo joins a path from the deploy config onto the repository, refusing anything that escapes it. Symlinks
+// are followed before checking, so a link in the repository can't point the build at files elsewhere on the host
+func resolveInRepo(workingDir string, relative string) (string, error) {
+	root, err := filepath.EvalSymlinks(workingDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the repository: %w", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(workingDir, filepath.FromSlash(relative)))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %v: %w", relative, err)
+	}
+
+	check, err := filepath.Rel(root, resolved)
+	if err != nil || check == ".." || strings.HasPrefix(check, "../") {
+		return "", fmt.Errorf("%v is outside of the repository", relative)
+	}
+	return resolved, nil
+}
+
+func ValidateArgsIfPresent(builderDir string, args map[string]interface{}) error {
 	content, err := os.ReadFile(path.Join(builderDir, "args.schema.json"))
 	if err != nil {
 		// Doesn't matter if files don't exist - just means we don't validate
@@ -254,7 +469,7 @@ func ValidateArgsIfPresent(config configs.DeployConfig, builderDir string, args
 	}
 
 	schema := gojsonschema.NewStringLoader(string(content))
-	data := gojsonschema.NewGoLoader(config.Builder.Args)
+	data := gojsonschema.NewGoLoader(args)
 
 	validate, err := gojsonschema.Validate(schema, data)
 	if err != nil {
@@ -270,3 +485,37 @@ func ValidateArgsIfPresent(config configs.DeployConfig, builderDir string, args
 
 	return nil
 }
+
+// UnifyArgsWithCueIfPresent unifies the args with args.cue from the builder if there is one, returning the args with
+// any defaults from the schema filled in
+func UnifyArgsWithCueIfPresent(builderDir string, args map[string]interface{}) (map[string]interface{}, error) {
+	file := path.Join(builderDir, "args.cue")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return args, nil
+		}
+		return nil, fmt.Errorf("could not load args.cue: %w", err)
+	}
+
+	ctx := cuecontext.New()
+	schema := ctx.CompileBytes(content, cue.Filename(file))
+	if schema.Err() != nil {
+		return nil, fmt.Errorf("could not compile args.cue: %v", strings.TrimSpace(cueerrors.Details(schema.Err(), nil)))
+	}
+
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	value := schema.Unify(ctx.Encode(args))
+	if err = value.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("args were invalid: %v", strings.TrimSpace(cueerrors.Details(err, nil)))
+	}
+
+	var result map[string]interface{}
+	if err = value.Decode(&result); err != nil {
+		return nil, fmt.Errorf("could not decode args: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"echo-cicd/configs"
+	"errors"
+	"fmt"
+	"golang.org/x/mod/semver"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// BuilderManifestFile is the name of the optional manifest in the root of each builder
+const BuilderManifestFile = "builder.toml"
+
+// ResolvedBuilder is a builder found on disk alongside its manifest. Builders without a builder.toml get a manifest
+// inferred from their folder name
+type ResolvedBuilder struct {
+	Dir      string
+	Manifest configs.BuilderManifest
+}
+
+// ParseBuilderId splits an id such as golang@2 into the builder name and the version it is pinned to, which is empty
+// if it isn't pinned
+func ParseBuilderId(id string) (name string, version string) {
+	name, version, _ = strings.Cut(id, "@")
+	return name, version
+}
+
+// ListBuilders returns every builder in the builders directory. Multiple versions of a builder live side by side in
+// folders named <name>@<version>, with an unversioned <name> folder also accepted. Builders whose manifest can't be
+// read or doesn't match their folder are logged and left out, so only the projects using them fail
+func ListBuilders(buildersDir string) ([]ResolvedBuilder, error) {
+	builders, invalid, err := listBuilders(buildersDir)
+	for folder, err := range invalid {
+		slog.Error("skipping invalid builder", "builder", folder, "err", err)
+	}
+	return builders, err
+}
+
+// listBuilders returns the valid builders in the builders directory, and the reason each invalid one was left out keyed
+// by its folder
+func listBuilders(buildersDir string) ([]ResolvedBuilder, map[string]error, error) {
+	entries, err := os.ReadDir(buildersDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list builders: %w", err)
+	}
+
+	result := make([]ResolvedBuilder, 0, len(entries))
+	invalid := map[string]error{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		dir := path.Join(buildersDir, entry.Name())
+		name, version := ParseBuilderId(entry.Name())
+
+		manifest := &configs.BuilderManifest{}
+		loaded, err := configs.LoadBuilderManifestFromFile(path.Join(dir, BuilderManifestFile))
+		if err == nil {
+			manifest = loaded
+		} else if !errors.Is(err, os.ErrNotExist) {
+			invalid[entry.Name()] = fmt.Errorf("builder %v: %w", entry.Name(), err)
+			continue
+		}
+
+		if manifest.Name == "" {
+			manifest.Name = name
+		}
+		if manifest.Version == "" {
+			manifest.Version = version
+		}
+		if manifest.Name != name {
+			invalid[entry.Name()] = fmt.Errorf("builder %v: manifest name %q does not match the folder name", entry.Name(), manifest.Name)
+			continue
+		}
+		if version != "" && manifest.Version != version {
+			invalid[entry.Name()] = fmt.Errorf("builder %v: manifest version %q does not match the folder name", entry.Name(), manifest.Version)
+			continue
+		}
+
+		result = append(result, ResolvedBuilder{Dir: dir, Manifest: *manifest})
+	}
+
+	return result, invalid, nil
+}
+
+// compareVersions orders builder versions semantically, so 10 sorts after 9. Versions which aren't semver sort first
+func compareVersions(a string, b string) int {
+	return semver.Compare("v"+strings.TrimPrefix(a, "v"), "v"+strings.TrimPrefix(b, "v"))
+}
+
+// matchesPin returns true if the version is the pinned version or a more specific version of it, so a pin of 2
+// matches 2, 2.1 and 2.1.3
+func matchesPin(version string, pin string) bool {
+	return version == pin || strings.HasPrefix(version, pin+".")
+}
+
+// ResolveBuilder finds the builder for an id from a deploy config. An id without a version resolves to the latest
+// version available, a pinned id resolves to the latest version matching the pin
+func ResolveBuilder(buildersDir string, id string) (*ResolvedBuilder, error) {
+	name, pin := ParseBuilderId(id)
+	if name == "" {
+		return nil, fmt.Errorf("invalid builder id %q", id)
+	}
+
+	builders, invalid, err := listBuilders(buildersDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// An invalid builder is only reported to the projects which could have used it
+	problems := make([]error, 0)
+	for folder, err := range invalid {
+		if folderName, _ := ParseBuilderId(folder); folderName == name {
+			problems = append(problems, err)
+		}
+	}
+	slices.SortFunc(problems, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+
+	candidates := slices.DeleteFunc(builders, func(builder ResolvedBuilder) bool {
+		return builder.Manifest.Name != name
+	})
+	if len(candidates) == 0 {
+		return nil, errors.Join(append([]error{fmt.Errorf("no builder named %q exists in %v", name, buildersDir)}, problems...)...)
+	}
+
+	matching := slices.DeleteFunc(slices.Clone(candidates), func(builder ResolvedBuilder) bool {
+		return pin != "" && !matchesPin(builder.Manifest.Version, pin)
+	})
+	if len(matching) == 0 {
+		versions := make([]string, 0, len(candidates))
+		for _, candidate := range candidates {
+			versions = append(versions, candidate.Manifest.Version)
+		}
+		slices.SortFunc(versions, compareVersions)
+		err = fmt.Errorf("builder %q has no version matching %q, available versions are: %v", name, pin, strings.Join(versions, ", "))
+		return nil, errors.Join(append([]error{err}, problems...)...)
+	}
+
+	latest := slices.MaxFunc(matching, func(a, b ResolvedBuilder) int {
+		return compareVersions(a.Manifest.Version, b.Manifest.Version)
+	})
+	return &latest, nil
+}
+
+// ApplyManifestArgs merges the builder's default args under the args from the deploy config and checks that every
+// required arg is present
+func ApplyManifestArgs(manifest configs.BuilderManifest, args map[string]interface{}) (map[string]interface{}, error) {
+	result := maps.Clone(manifest.DefaultArgs)
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	maps.Copy(result, args)
+
+	missing := make([]string, 0)
+	for _, required := range manifest.RequiredArgs {
+		if _, ok := result[required]; !ok {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("builder %v@%v requires args that were not provided: %v", manifest.Name, manifest.Version, strings.Join(missing, ", "))
+	}
+
+	return result, nil
+}
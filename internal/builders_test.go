@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveBuilderVersions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"golang/Dockerfile":       "FROM scratch",
+		"golang@1.2/builder.toml": "name = \"golang\"\nversion = \"1.2\"",
+		"golang@2/builder.toml":   "name = \"golang\"",
+		"golang@2.1/builder.toml": "name = \"golang\"\nversion = \"2.1\"",
+		"golang@10/Dockerfile":    "FROM scratch",
+		"node/builder.toml":       "name = \"node\"\nversion = \"20\"",
+		".git/builder.toml":       "name = \"git\"",
+		"README.md":               "# builders",
+	})
+
+	cases := []struct {
+		id      string
+		version string
+		folder  string
+	}{
+		{"golang", "10", "golang@10"},
+		{"golang@2", "2.1", "golang@2.1"},
+		{"golang@2.1", "2.1", "golang@2.1"},
+		{"golang@1", "1.2", "golang@1.2"},
+		{"node", "20", "node"},
+	}
+	for _, c := range cases {
+		builder, err := ResolveBuilder(dir, c.id)
+		if err != nil {
+			t.Errorf("failed to resolve %v: %v", c.id, err)
+			continue
+		}
+		if builder.Manifest.Version != c.version || filepath.Base(builder.Dir) != c.folder {
+			t.Errorf("expected %v to resolve to version %v in %v, got %v in %v", c.id, c.version, c.folder, builder.Manifest.Version, builder.Dir)
+		}
+	}
+
+	_, err := ResolveBuilder(dir, "golang@3")
+	if err == nil || !strings.Contains(err.Error(), "available versions are: , 1.2, 2, 2.1, 10") {
+		t.Errorf("expected the available versions to be listed, got %v", err)
+	}
+	if _, err = ResolveBuilder(dir, "rust"); err == nil {
+		t.Errorf("expected a missing builder to fail")
+	}
+}
+
+func TestListBuildersSkipsInvalidBuilders(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"golang/builder.toml":   "name = \"golang\"",
+		"node/builder.toml":     "name = \"deno\"",
+		"rust/builder.toml":     "name = ",
+		"python@3/builder.toml": "name = \"python\"\nversion = \"2\"",
+	})
+
+	builders, err := ListBuilders(dir)
+	if err != nil {
+		t.Fatalf("expected invalid builders to be skipped, got %v", err)
+	}
+	names := make([]string, 0, len(builders))
+	for _, builder := range builders {
+		names = append(names, builder.Manifest.Name)
+	}
+	if !slices.Equal(names, []string{"golang"}) {
+		t.Fatalf("expected only the valid builder to be listed, got %v", names)
+	}
+
+	if _, err = ResolveBuilder(dir, "golang"); err != nil {
+		t.Errorf("expected projects using a valid builder to be unaffected, got %v", err)
+	}
+
+	cases := map[string]string{
+		"node":     "manifest name \"deno\" does not match the folder name",
+		"rust":     "builder rust:",
+		"python@3": "manifest version \"2\" does not match the folder name",
+	}
+	for id, expected := range cases {
+		if _, err = ResolveBuilder(dir, id); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected resolving %v to report %q, got %v", id, expected, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuilderRepository keeps a local copy of builders stored in a git repository. Every commit is exported into its own
+// folder under the cache dir so a refresh never changes the files underneath a build that is already running, and a
+// folder is only removed once no build is using it
+type BuilderRepository struct {
+	Url string
+	// Ref is a branch, tag or commit to use, defaults to the repository's default branch
+	Ref      string
+	CacheDir string
+
+	refreshLock sync.Mutex
+	lock        sync.RWMutex
+	commit      string
+	// users counts the builds reading from each checkout, a checkout is only removed once nothing is using it
+	users map[string]int
+}
+
+// NewBuilderRepository prepares a cache of the builders in the repository, falling back to the last commit that was
+// fetched if the repository cannot be reached
+func NewBuilderRepository(ctx context.Context, repoUrl string, ref string, cacheDir string) (*BuilderRepository, error) {
+	repository := &BuilderRepository{Url: repoUrl, Ref: ref, CacheDir: cacheDir, users: map[string]int{}}
+
+	err := repository.Refresh(ctx)
+	if err == nil {
+		return repository, nil
+	}
+
+	current, readErr := os.ReadFile(filepath.Join(cacheDir, "current"))
+	if readErr != nil {
+		return nil, err
+	}
+
+	repository.commit = strings.TrimSpace(string(current))
+	slog.Error("failed to fetch builders, using the cached copy", "commit", repository.commit, "err", err)
+	return repository, nil
+}
+
+// Acquire returns the folder containing the builders from the most recently fetched commit. The folder is kept until
+// release is called, even if the builders are refreshed in the meantime
+func (repository *BuilderRepository) Acquire() (dir string, release func()) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	commit := repository.commit
+	repository.users[commit]++
+
+	var once sync.Once
+	return filepath.Join(repository.CacheDir, "checkouts", commit), func() {
+		once.Do(func() { repository.release(commit) })
+	}
+}
+
+// release gives up a use of a checkout, removing it if it is no longer current and nothing else is using it
+func (repository *BuilderRepository) release(commit string) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	repository.users[commit]--
+	if repository.users[commit] > 0 {
+		return
+	}
+	delete(repository.users, commit)
+	if commit != repository.commit {
+		repository.removeCheckout(commit)
+	}
+}
+
+// Commit returns the commit of the builder repository currently in use
+func (repository *BuilderRepository) Commit() string {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return repository.commit
+}
+
+// Matches returns true if a webhook payload is for the builder repository
+func (repository *BuilderRepository) Matches(repo Repository) bool {
+	normalise := func(value string) string {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(value, "/"), ".git"))
+	}
+
+	if repo.CloneUrl != "" && normalise(repo.CloneUrl) == normalise(repository.Url) {
+		return true
+	}
+
+	parsed, err := url.Parse(repository.Url)
+	return err == nil && repo.FullName != "" && normalise(strings.TrimPrefix(parsed.Path, "/")) == strings.ToLower(repo.FullName)
+}
+
+// Refresh fetches the repository and exports the configured ref if it has moved since the last refresh
+func (repository *BuilderRepository) Refresh(ctx context.Context) error {
+	repository.refreshLock.Lock()
+	defer repository.refreshLock.Unlock()
+
+	repo, err := repository.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	revision := repository.Ref
+	if revision == "" {
+		revision = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return fmt.Errorf("could not find %v in the builder repository: %w", revision, err)
+	}
+
+	commit := hash.String()
+	if commit == repository.Commit() {
+		return nil
+	}
+
+	checkout := filepath.Join(repository.CacheDir, "checkouts", commit)
+	if _, err = os.Stat(checkout); err != nil {
+		if err = exportCommit(repo, *hash, checkout); err != nil {
+			return err
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(repository.CacheDir, "current"), []byte(commit+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to record the current builder commit: %w", err)
+	}
+
+	repository.lock.Lock()
+	repository.commit = commit
+	repository.lock.Unlock()
+
+	slog.Info("updated builders", "url", repository.Url, "ref", revision, "commit", commit)
+	repository.prune()
+	return nil
+}
+
+// fetch clones the repository into the cache the first time, then fetches every branch and tag on later calls
+func (repository *BuilderRepository) fetch(ctx context.Context) (*git.Repository, error) {
+	gitDir := filepath.Join(repository.CacheDir, "repo.git")
+
+	repo, err := git.PlainOpen(gitDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainCloneContext(ctx, gitDir, true, &git.CloneOptions{URL: repository.Url})
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone builder repository: %w", err)
+		}
+		return repo, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open builder repository: %w", err)
+	}
+
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to fetch builder repository: %w", err)
+	}
+
+	return repo, nil
+}
+
+// prune removes exported commits other than the current one, leaving any a running build is still reading from to be
+// removed once it finishes
+func (repository *BuilderRepository) prune() {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(repository.CacheDir, "checkouts"))
+	if err != nil {
+		slog.Error("failed to list builder checkouts", "err", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == repository.commit || repository.users[entry.Name()] > 0 {
+			continue
+		}
+		repository.removeCheckout(entry.Name())
+	}
+}
+
+// removeCheckout deletes the export of a commit, the lock must be held
+func (repository *BuilderRepository) removeCheckout(commit string) {
+	if err := os.RemoveAll(filepath.Join(repository.CacheDir, "checkouts", commit)); err != nil {
+		slog.Error("failed to remove old builder checkout", "commit", commit, "err", err)
+	}
+}
+
+// LaunchRefresher refreshes the builders on an interval until the context is cancelled
+func (repository *BuilderRepository) LaunchRefresher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := repository.Refresh(ctx); err != nil {
+				slog.Error("failed to refresh builders", "url", repository.Url, "err", err)
+			}
+		}
+	}
+}
+
+// exportCommit writes the tree of the commit into the target folder, via a temporary folder so a partial export is
+// never used
+func exportCommit(repo *git.Repository, hash plumbing.Hash, target string) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("failed to load builder commit %v: %w", hash, err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("failed to load builder tree %v: %w", hash, err)
+	}
+
+	temp := target + ".tmp"
+	if err = os.RemoveAll(temp); err != nil {
+		return fmt.Errorf("failed to clear builder checkout: %w", err)
+	}
+	// The folder is created up front so a commit without any files still exports
+	if err = os.MkdirAll(temp, 0755); err != nil {
+		return fmt.Errorf("failed to create builder checkout: %w", err)
+	}
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		return exportFile(file, temp)
+	})
+	if err != nil {
+		_ = os.RemoveAll(temp)
+		return fmt.Errorf("failed to export builders: %w", err)
+	}
+
+	// A commit's export never changes, so one which already exists is kept as it may be in use
+	if _, err = os.Stat(target); err == nil {
+		return os.RemoveAll(temp)
+	}
+	if err = os.Rename(temp, target); err != nil {
+		_ = os.RemoveAll(temp)
+		return fmt.Errorf("failed to export builders: %w", err)
+	}
+	return nil
+}
+
+func exportFile(file *object.File, root string) error {
+	destination := filepath.Join(root, filepath.FromSlash(file.Name))
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, destination)
+	}
+
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	handle, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	_, err = io.Copy(handle, reader)
+	return err
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// commitFiles writes the files into the worktree of the repository and commits them, returning the commit
+func commitFiles(t *testing.T, repo *git.Repository, dir string, files map[string]string) plumbing.Hash {
+	t.Helper()
+
+	writeFiles(t, dir, files)
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("failed to open worktree: %v", err)
+	}
+	if err = worktree.AddGlob("."); err != nil && len(files) > 0 {
+		t.Fatalf("failed to stage files: %v", err)
+	}
+
+	hash, err := worktree.Commit("update builders", &git.CommitOptions{
+		AllowEmptyCommits: true,
+		Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	return hash
+}
+
+func TestExportCommit(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "checkouts", "empty")
+
+	// A commit without any files still exports to an empty folder
+	empty := commitFiles(t, repo, dir, nil)
+	if err = exportCommit(repo, empty, target); err != nil {
+		t.Fatalf("failed to export an empty commit: %v", err)
+	}
+	if entries, err := os.ReadDir(target); err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty checkout, got %v: %v", entries, err)
+	}
+
+	hash := commitFiles(t, repo, dir, map[string]string{"golang/builder.toml": "name = \"golang\""})
+	target = filepath.Join(filepath.Dir(target), hash.String())
+	if err = exportCommit(repo, hash, target); err != nil {
+		t.Fatalf("failed to export commit: %v", err)
+	}
+
+	// Exporting a commit which was already exported keeps the existing checkout
+	if err = exportCommit(repo, hash, target); err != nil {
+		t.Fatalf("failed to export a commit twice: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(target, "golang", "builder.toml")); err != nil || string(content) != "name = \"golang\"" {
+		t.Fatalf("expected the builder to be exported, got %q: %v", content, err)
+	}
+	if _, err = os.Stat(target + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary export to be removed, got %v", err)
+	}
+}
+
+func TestBuilderCheckoutsKeptWhileInUse(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	commitFiles(t, repo, dir, map[string]string{"golang/builder.toml": "version = 1"})
+
+	builders, err := NewBuilderRepository(ctx, dir, "", t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to fetch builders: %v", err)
+	}
+
+	inUse, release := builders.Acquire()
+	unused, releaseUnused := builders.Acquire()
+	releaseUnused()
+	releaseUnused()
+	if unused != inUse {
+		t.Fatalf("expected both builds to use the current checkout")
+	}
+
+	// The checkout stays while its build is running, however many refreshes happen
+	refreshes := make([]string, 0)
+	for _, version := range []string{"2", "3"} {
+		commitFiles(t, repo, dir, map[string]string{"golang/builder.toml": "version = " + version})
+		if err = builders.Refresh(ctx); err != nil {
+			t.Fatalf("failed to refresh builders: %v", err)
+		}
+		refreshes = append(refreshes, filepath.Join(builders.CacheDir, "checkouts", builders.Commit()))
+	}
+	if _, err = os.Stat(inUse); err != nil {
+		t.Fatalf("expected the checkout in use to be kept: %v", err)
+	}
+	if _, err = os.Stat(refreshes[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected the unused checkout of an old commit to be removed, got %v", err)
+	}
+
+	release()
+	if _, err = os.Stat(inUse); !os.IsNotExist(err) {
+		t.Fatalf("expected the old checkout to be removed once its build finished, got %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(refreshes[1], "golang", "builder.toml")); err != nil || string(content) != "version = 3" {
+		t.Fatalf("expected the current checkout to hold the latest builders, got %q: %v", content, err)
+	}
+}
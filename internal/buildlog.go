@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// BuildLog is an in-memory, append only log of the output of a single build which can be followed by any number of
+// readers while the build is still running
+type BuildLog struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	closed bool
+}
+
+func NewBuildLog() *BuildLog {
+	buildLog := &BuildLog{}
+	buildLog.cond = sync.NewCond(&buildLog.lock)
+	return buildLog
+}
+
+func (buildLog *BuildLog) Write(p []byte) (int, error) {
+	buildLog.lock.Lock()
+	defer buildLog.lock.Unlock()
+
+	if buildLog.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	buildLog.data = append(buildLog.data, p...)
+	buildLog.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close marks the log as complete, releasing anyone following it
+func (buildLog *BuildLog) Close() {
+	buildLog.lock.Lock()
+	defer buildLog.lock.Unlock()
+
+	buildLog.closed = true
+	buildLog.cond.Broadcast()
+}
+
+// Follow copies the log to the writer from the start, blocking for new output until the log is closed or the context
+// is cancelled. flush is called after each chunk is written, if provided
+func (buildLog *BuildLog) Follow(ctx context.Context, writer io.Writer, flush func()) error {
+	stop := context.AfterFunc(ctx, func() {
+		buildLog.lock.Lock()
+		defer buildLog.lock.Unlock()
+		buildLog.cond.Broadcast()
+	})
+	defer stop()
+
+	offset := 0
+	for {
+		buildLog.lock.Lock()
+		for offset == len(buildLog.data) && !buildLog.closed && ctx.Err() == nil {
+			buildLog.cond.Wait()
+		}
+		chunk := buildLog.data[offset:]
+		closed := buildLog.closed
+		buildLog.lock.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if len(chunk) > 0 {
+			if _, err := writer.Write(chunk); err != nil {
+				return err
+			}
+			offset += len(chunk)
+			if flush != nil {
+				flush()
+			}
+		}
+
+		if closed && len(chunk) == 0 {
+			return nil
+		}
+	}
+}
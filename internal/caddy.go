@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"echo-cicd/configs"
+	"encoding/json"
+	"fmt"
+	docker "github.com/docker/docker/client"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CaddyClient manages a route for every deployed project with a domain through the Caddy admin API, as an alternative
+// to the domain labels read by the caddy docker plugin. Each route is tagged with an @id so it can be replaced or
+// removed in a single request, which Caddy applies atomically
+type CaddyClient struct {
+	// AdminUrl is the address of the admin API, ie http://localhost:2019
+	AdminUrl string
+	// Server is the name of the http server the routes are added to, it is created if it doesn't exist
+	Server string
+	// Listen is the address the server listens on when it has to be created
+	Listen string
+	// UpstreamHost is the host Caddy reaches the containers' published ports on
+	UpstreamHost string
+	Client       *http.Client
+}
+
+// caddyRoute is a route in the http app of the Caddy JSON config, reverse proxying a host to the upstreams
+type caddyRoute struct {
+	Id       string         `json:"@id"`
+	Match    []caddyMatch   `json:"match"`
+	Handle   []caddyHandler `json:"handle"`
+	Terminal bool           `json:"terminal"`
+}
+
+type caddyMatch struct {
+	Host []string `json:"host"`
+}
+
+type caddyHandler struct {
+	Handler   string          `json:"handler"`
+	Upstreams []caddyUpstream `json:"upstreams"`
+}
+
+type caddyUpstream struct {
+	Dial string `json:"dial"`
+}
+
+// CaddyRouteId returns the @id of the route for a project
+func CaddyRouteId(key string) string {
+	return "echocicd-" + key
+}
+
+func (caddy CaddyClient) do(ctx context.Context, method string, path string, body any) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to serialise caddy config: %w", err)
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(caddy.AdminUrl, "/")+path, reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create caddy request: %w", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := caddy.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, nil, fmt.Errorf("caddy request failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read caddy response: %w", err)
+	}
+	return response.StatusCode, content, nil
+}
+
+func (caddy CaddyClient) serverPath() string {
+	return "/config/apps/http/servers/" + url.PathEscape(caddy.Server)
+}
+
+// EnsureServer creates the http server the routes are added to, along with the http app if Caddy has no config yet.
+// An existing server is left as it is
+func (caddy CaddyClient) EnsureServer(ctx context.Context) error {
+	parts := []string{"apps", "http", "servers", caddy.Server}
+
+	// Find the first part of the path that doesn't exist yet, then create everything from there down in one request
+	for depth := 1; depth <= len(parts); depth++ {
+		path := "/config/" + escapePath(parts[:depth])
+		status, content, err := caddy.do(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("caddy responded to GET %v with %v: %v", path, status, strings.TrimSpace(string(content)))
+		}
+		if strings.TrimSpace(string(content)) != "null" {
+			continue
+		}
+
+		var value any = map[string]any{"listen": []string{caddy.Listen}, "routes": []any{}}
+		for i := len(parts) - 1; i >= depth; i-- {
+			value = map[string]any{parts[i]: value}
+		}
+
+		status, content, err = caddy.do(ctx, http.MethodPost, path, value)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("caddy responded to POST %v with %v: %v", path, status, strings.TrimSpace(string(content)))
+		}
+		return nil
+	}
+	return nil
+}
+
+func escapePath(parts []string) string {
+	escaped := make([]string, 0, len(parts))
+	for _, part := range parts {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	return strings.Join(escaped, "/")
+}
+
+// SetRoute points the host at the upstream ports, replacing the project's existing route or adding one if it has none
+func (caddy CaddyClient) SetRoute(ctx context.Context, key string, host string, ports []int) error {
+	if len(ports) == 0 {
+		return fmt.Errorf("no upstreams to route %v to", host)
+	}
+
+	route := caddyRoute{
+		Id:       CaddyRouteId(key),
+		Match:    []caddyMatch{{Host: []string{host}}},
+		Handle:   []caddyHandler{{Handler: "reverse_proxy"}},
+		Terminal: true,
+	}
+	for _, port := range ports {
+		route.Handle[0].Upstreams = append(route.Handle[0].Upstreams, caddyUpstream{Dial: caddy.UpstreamHost + ":" + strconv.Itoa(port)})
+	}
+
+	status, content, err := caddy.do(ctx, http.MethodPatch, "/id/"+url.PathEscape(route.Id), route)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK {
+		return nil
+	}
+
+	// Caddy reports an unknown @id as a 404, in which case this is the project's first route
+	if status != http.StatusNotFound {
+		return fmt.Errorf("caddy responded to route update with %v: %v", status, strings.TrimSpace(string(content)))
+	}
+
+	status, content, err = caddy.do(ctx, http.MethodPost, caddy.serverPath()+"/routes", route)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy responded to new route with %v: %v", status, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// RemoveRoute removes the project's route, a project without a route is not an error
+func (caddy CaddyClient) RemoveRoute(ctx context.Context, key string) error {
+	status, content, err := caddy.do(ctx, http.MethodDelete, "/id/"+url.PathEscape(CaddyRouteId(key)), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("caddy responded to route removal with %v: %v", status, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// ContainerUpstreams returns the host ports the domain of a build is published on by its running containers, one per
+// replica, read back from docker so they match whatever ports were allocated
+func ContainerUpstreams(build PublishedBuild, conn *docker.Client) ([]int, error) {
+	if build.Exec.Domain == nil {
+		return nil, nil
+	}
+
+	routed := build.Exec.Domain.ContainerPort
+	if routed == "" {
+		routed = configs.PortForDomain(build.Exec.Ports, build.Exec.Domain.Port)
+	}
+	if routed == "" {
+		return nil, fmt.Errorf("the domain routes to port %v which is not published", build.Exec.Domain.Port)
+	}
+	number, proto, _ := strings.Cut(routed, "/")
+	if proto == "" {
+		proto = "tcp"
+	}
+
+	containers, err := listManagedContainers("echo-project="+build.Name, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make([]int, 0, len(containers))
+	for _, t := range containers {
+		if t.State != "running" {
+			continue
+		}
+		for _, port := range t.Ports {
+			if strconv.Itoa(int(port.PrivatePort)) == number && port.Type == proto && port.PublicPort != 0 {
+				ports = append(ports, int(port.PublicPort))
+			}
+		}
+	}
+
+	// Ports bound on both IPv4 and IPv6 are listed twice
+	slices.Sort(ports)
+	return slices.Compact(ports), nil
+}
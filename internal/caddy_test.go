@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCaddy is the part of the Caddy admin API the client uses, holding the JSON config in memory and recording every
+// request it receives
+type fakeCaddy struct {
+	lock     sync.Mutex
+	config   any
+	requests []string
+	// fail is returned as the status of every request when set
+	fail int
+}
+
+func newFakeCaddy(t *testing.T) (*fakeCaddy, CaddyClient) {
+	t.Helper()
+
+	fake := &fakeCaddy{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, CaddyClient{AdminUrl: server.URL + "/", Server: "echocicd", Listen: ":443", UpstreamHost: "localhost"}
+}
+
+func (fake *fakeCaddy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.requests = append(fake.requests, request.Method+" "+request.URL.Path)
+	if fake.fail != 0 {
+		http.Error(writer, "caddy is unavailable", fake.fail)
+		return
+	}
+
+	var body any
+	if request.Body != nil && request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if path, ok := strings.CutPrefix(request.URL.Path, "/config/"); ok {
+		fake.serveConfig(writer, request.Method, strings.FieldsFunc(path, func(r rune) bool { return r == '/' }), body)
+		return
+	}
+	if id, ok := strings.CutPrefix(request.URL.Path, "/id/"); ok {
+		fake.serveId(writer, request.Method, id, body)
+		return
+	}
+	http.NotFound(writer, request)
+}
+
+func (fake *fakeCaddy) serveConfig(writer http.ResponseWriter, method string, parts []string, body any) {
+	switch method {
+	case http.MethodGet:
+		_ = json.NewEncoder(writer).Encode(lookupConfig(fake.config, parts))
+	case http.MethodPost:
+		// Posting to an array appends to it, anything else is set as long as its parent exists
+		if existing, ok := lookupConfig(fake.config, parts).([]any); ok {
+			body = append(existing, body)
+		}
+		if len(parts) == 0 {
+			fake.config = body
+			return
+		}
+		if fake.config == nil && len(parts) == 1 {
+			fake.config = map[string]any{}
+		}
+		parent, ok := lookupConfig(fake.config, parts[:len(parts)-1]).(map[string]any)
+		if !ok {
+			http.Error(writer, "parent of "+strings.Join(parts, "/")+" does not exist", http.StatusBadRequest)
+			return
+		}
+		parent[parts[len(parts)-1]] = body
+	default:
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (fake *fakeCaddy) serveId(writer http.ResponseWriter, method string, id string, body any) {
+	servers, _ := lookupConfig(fake.config, []string{"apps", "http", "servers"}).(map[string]any)
+	for _, server := range servers {
+		routes, _ := server.(map[string]any)["routes"].([]any)
+		for i, route := range routes {
+			if route.(map[string]any)["@id"] != id {
+				continue
+			}
+			switch method {
+			case http.MethodPatch:
+				routes[i] = body
+			case http.MethodDelete:
+				server.(map[string]any)["routes"] = slices.Delete(routes, i, i+1)
+			default:
+				http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+	}
+	http.Error(writer, "unknown object ID '"+id+"'", http.StatusNotFound)
+}
+
+func lookupConfig(value any, parts []string) any {
+	for _, part := range parts {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// routes returns the routes of the server the client manages
+func (fake *fakeCaddy) routes(t *testing.T) []caddyRoute {
+	t.Helper()
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	content, err := json.Marshal(lookupConfig(fake.config, []string{"apps", "http", "servers", "echocicd", "routes"}))
+	if err != nil {
+		t.Fatalf("failed to serialise routes: %v", err)
+	}
+	var routes []caddyRoute
+	if err = json.Unmarshal(content, &routes); err != nil {
+		t.Fatalf("failed to parse routes: %v", err)
+	}
+	return routes
+}
+
+func (fake *fakeCaddy) takeRequests() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	requests := fake.requests
+	fake.requests = nil
+	return requests
+}
+
+func TestCaddyEnsureServer(t *testing.T) {
+	fake, caddy := newFakeCaddy(t)
+	ctx := context.Background()
+
+	if err := caddy.EnsureServer(ctx); err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	expected := []string{"GET /config/apps", "POST /config/apps"}
+	if requests := fake.takeRequests(); !slices.Equal(requests, expected) {
+		t.Fatalf("expected the whole http app to be created at once with %v, got %v", expected, requests)
+	}
+
+	server, _ := lookupConfig(fake.config, []string{"apps", "http", "servers", "echocicd"}).(map[string]any)
+	if listen, _ := server["listen"].([]any); len(listen) != 1 || listen[0] != ":443" {
+		t.Fatalf("expected the server to listen on :443, got %v", server)
+	}
+	if routes, ok := server["routes"].([]any); !ok || len(routes) != 0 {
+		t.Fatalf("expected the server to start without routes, got %v", server)
+	}
+
+	// An existing server is left alone
+	if err := caddy.EnsureServer(ctx); err != nil {
+		t.Fatalf("failed to check existing server: %v", err)
+	}
+	for _, request := range fake.takeRequests() {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Fatalf("expected an existing server to only be read, got %v", request)
+		}
+	}
+}
+
+func TestCaddySetRoute(t *testing.T) {
+	fake, caddy := newFakeCaddy(t)
+	ctx := context.Background()
+	if err := caddy.EnsureServer(ctx); err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	fake.takeRequests()
+
+	// The first route of a project isn't known by its @id yet so it is added to the server
+	if err := caddy.SetRoute(ctx, "ryan__app", "app.example.com", []int{8080}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	expected := []string{"PATCH /id/echocicd-ryan__app", "POST /config/apps/http/servers/echocicd/routes"}
+	if requests := fake.takeRequests(); !slices.Equal(requests, expected) {
+		t.Fatalf("expected %v, got %v", expected, requests)
+	}
+
+	if err := caddy.SetRoute(ctx, "ryan__app", "app.example.com", []int{8081, 8082}); err != nil {
+		t.Fatalf("failed to update route: %v", err)
+	}
+	expected = []string{"PATCH /id/echocicd-ryan__app"}
+	if requests := fake.takeRequests(); !slices.Equal(requests, expected) {
+		t.Fatalf("expected the route to be replaced in place with %v, got %v", expected, requests)
+	}
+
+	routes := fake.routes(t)
+	if len(routes) != 1 || routes[0].Id != "echocicd-ryan__app" || routes[0].Match[0].Host[0] != "app.example.com" {
+		t.Fatalf("expected a single route for app.example.com, got %+v", routes)
+	}
+	upstreams := routes[0].Handle[0].Upstreams
+	if len(upstreams) != 2 || upstreams[0].Dial != "localhost:8081" || upstreams[1].Dial != "localhost:8082" {
+		t.Fatalf("expected the route to point at both replicas, got %+v", upstreams)
+	}
+
+	if err := caddy.SetRoute(ctx, "ryan__app", "app.example.com", nil); err == nil {
+		t.Fatalf("expected a route without upstreams to be refused")
+	}
+}
+
+func TestCaddyRemoveRoute(t *testing.T) {
+	fake, caddy := newFakeCaddy(t)
+	ctx := context.Background()
+	if err := caddy.EnsureServer(ctx); err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := caddy.SetRoute(ctx, "ryan__app", "app.example.com", []int{8080}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+
+	if err := caddy.RemoveRoute(ctx, "ryan__app"); err != nil {
+		t.Fatalf("failed to remove route: %v", err)
+	}
+	if routes := fake.routes(t); len(routes) != 0 {
+		t.Fatalf("expected the route to be removed, got %+v", routes)
+	}
+
+	// A project without a route has nothing to remove
+	if err := caddy.RemoveRoute(ctx, "ryan__app"); err != nil {
+		t.Fatalf("expected removing a missing route to succeed, got %v", err)
+	}
+}
+
+func TestCaddyErrors(t *testing.T) {
+	fake, caddy := newFakeCaddy(t)
+	fake.fail = http.StatusInternalServerError
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"EnsureServer": func() error { return caddy.EnsureServer(ctx) },
+		"SetRoute":     func() error { return caddy.SetRoute(ctx, "ryan__app", "app.example.com", []int{8080}) },
+		"RemoveRoute":  func() error { return caddy.RemoveRoute(ctx, "ryan__app") },
+	}
+	for name, call := range calls {
+		err := call()
+		if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "caddy is unavailable") {
+			t.Errorf("expected %v to report the status and body of the failed request, got %v", name, err)
+		}
+	}
+}
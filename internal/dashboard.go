@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// eventKeepAlive is how often a comment is sent down idle event streams so proxies don't close them
+const eventKeepAlive = 30 * time.Second
+
+// RegisterDashboardHandlers serves the read-only web dashboard and the server-sent event stream it uses to refresh.
+// The static files carry no data so are served without a token, everything they load goes through the API
+func RegisterDashboardHandlers(mux *http.ServeMux, configuration WebhookConfiguration) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// Only possible if the embed directive is wrong
+		panic(err)
+	}
+
+	mux.Handle("/", http.FileServerFS(files))
+
+	mux.HandleFunc("GET /api/events", RequireRole(configuration.Etcd, RoleViewer, func(writer http.ResponseWriter, request *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		token := TokenFromContext(request.Context())
+		keys := configuration.Etcd.WatchKeys(request.Context(), "echocicd/")
+		builds, stop := configuration.Tracker.Watch()
+		defer stop()
+
+		ticker := time.NewTicker(eventKeepAlive)
+		defer ticker.Stop()
+
+		for {
+			var err error
+			select {
+			case key, ok := <-keys:
+				if !ok {
+					return
+				}
+				// Changes are only sent for projects the token can see, which also keeps tokens themselves out
+				if project, ok := projectOfKey(key); !ok || !token.CanAccess(RepoFromProjectKey(project)) {
+					continue
+				}
+				_, err = fmt.Fprintf(writer, "event: etcd\ndata: %v\n\n", key)
+			case <-builds:
+				_, err = fmt.Fprint(writer, "event: builds\ndata: {}\n\n")
+			case <-ticker.C:
+				_, err = fmt.Fprint(writer, ": keep-alive\n\n")
+			case <-request.Context().Done():
+				return
+			}
+
+			if err != nil {
+				slog.Debug("event stream closed", "err", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}))
+}
+
+// projectOfKey returns the project an etcd key belongs to, or false for keys which don't belong to a project
+func projectOfKey(key string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, "echocicd/"), "/")
+	switch {
+	case len(parts) >= 2 && slices.Contains([]string{"builds", "history", "pending", "frozen", "stopped", "previews"}, parts[0]):
+		return parts[1], true
+	case len(parts) == 4 && parts[0] == "agents" && parts[2] == "deployments":
+		return parts[3], true
+	}
+	return "", false
+}
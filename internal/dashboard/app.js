@@ -0,0 +1,138 @@
+const projectsBody = document.getElementById('projects');
+const buildsBody = document.getElementById('builds');
+const connection = document.getElementById('connection');
+
+function element(tag, text, className) {
+    const node = document.createElement(tag);
+    if (text !== undefined) node.textContent = text;
+    if (className) node.className = className;
+    return node;
+}
+
+function status(value) {
+    return element('span', value, 'status ' + value);
+}
+
+function row(...cells) {
+    const tr = element('tr');
+    for (const cell of cells) {
+        const td = element('td');
+        if (cell instanceof Node) {
+            td.appendChild(cell);
+        } else {
+            td.textContent = cell ?? '';
+        }
+        tr.appendChild(td);
+    }
+    return tr;
+}
+
+function link(href, text) {
+    const a = element('a', text);
+    a.href = href;
+    return a;
+}
+
+// The API requires a viewer token, which is kept in a cookie so that the event stream is authenticated too
+function login() {
+    const token = window.prompt('API token (see echocicd token create)');
+    if (!token) return false;
+    document.cookie = 'echocicd_token=' + encodeURIComponent(token) + '; path=/; SameSite=Strict';
+    return true;
+}
+
+async function get(path) {
+    const response = await fetch(path);
+    if (response.status === 401 && login()) return get(path);
+    if (!response.ok) throw new Error(path + ' responded with ' + response.status);
+    return response.json();
+}
+
+// Returns the most recently queued build for each repo
+function latestBuilds(builds) {
+    const latest = {};
+    for (const build of builds) {
+        latest[build.repo] = build;
+    }
+    return latest;
+}
+
+async function refresh() {
+    const [projects, builds, deployments] = await Promise.all([
+        get('api/projects'),
+        get('api/builds'),
+        get('api/deployments'),
+    ]);
+    const latest = latestBuilds(builds);
+
+    projectsBody.replaceChildren(...projects.map(project => {
+        const build = latest[project.repo];
+        const agents = element('div');
+        for (const deployment of deployments.filter(d => d.project === project.key)) {
+            const entry = element('div');
+            entry.append(status(deployment.state), ' ', deployment.agent, ' ');
+            entry.appendChild(element('code', deployment.version.substring(0, 8), 'muted'));
+            if (deployment.pending) {
+                entry.append(' pending ');
+                entry.appendChild(element('code', deployment.pending.substring(0, 8), 'muted'));
+                if (deployment.scheduledFor) entry.append(' at ' + new Date(deployment.scheduledFor).toLocaleString());
+            }
+            if (deployment.error) entry.title = deployment.error;
+            agents.appendChild(entry);
+        }
+
+        const domain = project.exec.domain ? link('//' + project.exec.domain.host, project.exec.domain.host) : '';
+        const buildCell = build ? element('div') : '';
+        if (build) {
+            buildCell.append(status(build.status), ' ', link('api/builds/' + build.id + '/log', 'log'));
+        }
+
+        return row(
+            project.name,
+            project.repo,
+            element('code', project.version.substring(0, 8)),
+            new Date(project.timestamp).toLocaleString(),
+            buildCell,
+            agents,
+            domain,
+        );
+    }));
+
+    buildsBody.replaceChildren(...builds.reverse().map(build => row(
+        element('code', build.id),
+        build.repo,
+        build.ref,
+        status(build.status),
+        new Date(build.queued).toLocaleString(),
+        link('api/builds/' + build.id + '/log', 'log'),
+    )));
+}
+
+// Changes tend to arrive in bursts (a single publish writes several keys) so coalesce them into one refresh
+let pending = null;
+
+function scheduleRefresh() {
+    if (pending) return;
+    pending = setTimeout(() => {
+        pending = null;
+        refresh().catch(console.error);
+    }, 250);
+}
+
+function connect() {
+    const events = new EventSource('api/events');
+    events.onopen = () => {
+        connection.textContent = 'live';
+        connection.className = 'status connected';
+        scheduleRefresh();
+    };
+    events.onerror = () => {
+        connection.textContent = 'disconnected';
+        connection.className = 'status disconnected';
+    };
+    events.addEventListener('etcd', scheduleRefresh);
+    events.addEventListener('builds', scheduleRefresh);
+}
+
+// Load once before connecting so that the token prompt happens before the event stream is opened
+refresh().catch(console.error).finally(connect);
@@ -10,11 +10,18 @@ import (
 	etcd "go.etcd.io/etcd/client/v3"
 	"log/slog"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// ErrBuildNotFound is returned when no build has been published for a project
+var ErrBuildNotFound = errors.New("no build has been published")
+
+// ErrProjectStopped is returned when publishing a build of a project which has been undeployed and not restored
+var ErrProjectStopped = errors.New("the project has been undeployed, restore it to deploy it again")
+
 type EtcdClient struct {
 	client *etcd.Client
 }
@@ -31,26 +38,75 @@ func NewClient(endpoints []string) (*EtcdClient, error) {
 	return &EtcdClient{client: client}, nil
 }
 
+// ProjectKey converts a repo name into the key under which its builds are stored
+func ProjectKey(repo string) string {
+	return strings.ReplaceAll(repo, "/", "__")
+}
+
+// DeploymentKey is the key under which builds of an environment of a repo are stored, the project key for the base
+// config or <project key>@<environment> otherwise
+func DeploymentKey(repo string, environment string) string {
+	if environment == "" {
+		return ProjectKey(repo)
+	}
+	return ProjectKey(repo) + "@" + environment
+}
+
+// RepoFromProjectKey reverses ProjectKey, dropping the environment from a DeploymentKey
+func RepoFromProjectKey(project string) string {
+	project, _, _ = strings.Cut(project, "@")
+	return strings.ReplaceAll(project, "__", "/")
+}
+
 func CollapseToErr[T any](_ T, err error) error {
 	return err
 }
 
 func (client *EtcdClient) WatchForBuild(ctx context.Context, handler func(config PublishedBuild), async bool) {
+	client.watchBuildKey(ctx, "exec", handler, async)
+}
+
+// WatchForRetired calls the handler with every build that is marked as retired
+func (client *EtcdClient) WatchForRetired(ctx context.Context, handler func(config PublishedBuild), async bool) {
+	client.watchBuildKey(ctx, "retired", handler, async)
+}
+
+// WatchForDeleted calls the handler with the key of every build whose records are deleted from etcd
+func (client *EtcdClient) WatchForDeleted(ctx context.Context, handler func(key string)) {
+	watcher := client.client.Watch(ctx, "echocicd/builds/", etcd.WithPrefix())
+	buildKey := regexp.MustCompile("^echocicd/builds/([^/]+)/exec$")
+	for {
+		select {
+		case event := <-watcher:
+			for _, e := range event.Events {
+				if match := buildKey.FindSubmatch(e.Kv.Key); e.Type == mvccpb.DELETE && match != nil {
+					slog.Debug("found a deleted build", "event", e)
+					handler(string(match[1]))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchBuildKey calls the handler with the stored build whenever the named key of a build is written
+func (client *EtcdClient) watchBuildKey(ctx context.Context, name string, handler func(config PublishedBuild), async bool) {
 	watcher := client.client.Watch(ctx, "echocicd", etcd.WithPrefix())
-	buildKey := regexp.MustCompile("^echocicd/builds/[^/]+/exec$")
+	buildKey := regexp.MustCompile("^echocicd/builds/[^/]+/" + regexp.QuoteMeta(name) + "$")
 	for {
 		select {
 		case event := <-watcher:
 			for _, e := range event.Events {
 				if e.Type == mvccpb.PUT && buildKey.Match(e.Kv.Key) {
-					slog.Debug("found a new build", "event", e)
+					slog.Debug("found a build change", "event", e, "key", name)
 
 					key := string(e.Kv.Key)[16:]
 					key = key[:strings.Index(key, "/")]
 
 					build, err := client.GetStoredConfig(ctx, key)
 					if err != nil {
-						slog.Error("failed to handle new build", "err", err)
+						slog.Error("failed to handle build change", "key", name, "err", err)
 						continue
 					}
 
@@ -69,18 +125,79 @@ func (client *EtcdClient) WatchForBuild(ctx context.Context, handler func(config
 	}
 }
 
+// WatchKeys sends the key of every change made under the prefix until the context is cancelled
+func (client *EtcdClient) WatchKeys(ctx context.Context, prefix string) <-chan string {
+	keys := make(chan string)
+	watcher := client.client.Watch(ctx, prefix, etcd.WithPrefix())
+
+	go func() {
+		defer close(keys)
+		for event := range watcher {
+			for _, e := range event.Events {
+				select {
+				case keys <- string(e.Kv.Key):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return keys
+}
+
 func (client *EtcdClient) GetStoredConfig(ctx context.Context, build string) (*PublishedBuild, error) {
-	entries, err := client.client.Get(ctx, "echocicd/builds/"+build, etcd.WithPrefix())
+	entries, err := client.client.Get(ctx, "echocicd/builds/"+build+"/", etcd.WithPrefix())
 	if err != nil {
 		return nil, fmt.Errorf("failed to query for build: %w", err)
 	}
+	if len(entries.Kvs) == 0 {
+		return nil, fmt.Errorf("%w for %v", ErrBuildNotFound, build)
+	}
 
 	keyMap := map[string]string{}
 	for _, kv := range entries.Kvs {
 		keyMap[string(kv.Key)] = string(kv.Value)
 	}
 
-	config := PublishedBuild{}
+	return parsePublishedBuild(build, keyMap)
+}
+
+// ListStoredConfigs returns the current published build for every project, skipping any which are incomplete
+func (client *EtcdClient) ListStoredConfigs(ctx context.Context) ([]PublishedBuild, error) {
+	entries, err := client.client.Get(ctx, "echocicd/builds/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for builds: %w", err)
+	}
+
+	keyMap := map[string]string{}
+	builds := make([]string, 0)
+	for _, kv := range entries.Kvs {
+		key := string(kv.Key)
+		keyMap[key] = string(kv.Value)
+
+		build := strings.TrimPrefix(key, "echocicd/builds/")
+		build = build[:max(strings.Index(build, "/"), 0)]
+		if build != "" && !slices.Contains(builds, build) {
+			builds = append(builds, build)
+		}
+	}
+
+	result := make([]PublishedBuild, 0, len(builds))
+	for _, build := range builds {
+		config, err := parsePublishedBuild(build, keyMap)
+		if err != nil {
+			slog.Warn("skipping incomplete build", "build", build, "err", err)
+			continue
+		}
+		result = append(result, *config)
+	}
+
+	return result, nil
+}
+
+func parsePublishedBuild(build string, keyMap map[string]string) (*PublishedBuild, error) {
+	config := PublishedBuild{Key: build}
 	if name, ok := keyMap["echocicd/builds/"+build+"/name"]; ok {
 		config.Name = name
 	} else {
@@ -118,7 +235,7 @@ func (client *EtcdClient) GetStoredConfig(ctx context.Context, build string) (*P
 	if execRaw, ok := keyMap["echocicd/builds/"+build+"/exec"]; ok {
 		var execConfig configs.ExecProperties
 
-		err = json.Unmarshal([]byte(execRaw), &execConfig)
+		err := json.Unmarshal([]byte(execRaw), &execConfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse exec config: %w", err)
 		}
@@ -128,26 +245,349 @@ func (client *EtcdClient) GetStoredConfig(ctx context.Context, build string) (*P
 		return nil, errors.New("failed to find build exec")
 	}
 
+	// Older builds were written without the repo, environment, ref or digest so they are optional
+	config.Repo = keyMap["echocicd/builds/"+build+"/repo"]
+	config.Environment = keyMap["echocicd/builds/"+build+"/environment"]
+	config.Ref = keyMap["echocicd/builds/"+build+"/ref"]
+
+	if retired, ok := keyMap["echocicd/builds/"+build+"/retired"]; ok {
+		config.Retired, _ = strconv.ParseInt(retired, 10, 64)
+	}
+	config.Digest = keyMap["echocicd/builds/"+build+"/digest"]
+	config.PurgeImages = keyMap["echocicd/builds/"+build+"/purge"] == "images"
+	config.IgnoreWindow = keyMap["echocicd/builds/"+build+"/ignore-window"] == "true"
+
 	return &config, nil
 }
 
-func (client *EtcdClient) WriteBuildInfo(repo string, name string, hash string, tag string, registry string, config configs.ExecProperties) error {
-	slog.Info("writing", "repo", repo, "name", name, "hash", hash, "tag", tag, "registry", registry, "client", client)
+// GetHistory returns the builds published for a project, newest first
+func (client *EtcdClient) GetHistory(ctx context.Context, build string, limit int64) ([]PublishedBuild, error) {
+	entries, err := client.client.Get(
+		ctx,
+		"echocicd/history/"+build+"/",
+		etcd.WithPrefix(),
+		etcd.WithSort(etcd.SortByKey, etcd.SortDescend),
+		etcd.WithLimit(limit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for history: %w", err)
+	}
 
-	j, err := json.Marshal(config)
+	result := make([]PublishedBuild, 0, len(entries.Kvs))
+	for _, kv := range entries.Kvs {
+		var config PublishedBuild
+		err = json.Unmarshal(kv.Value, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse history entry %v: %w", string(kv.Key), err)
+		}
+		result = append(result, config)
+	}
+
+	return result, nil
+}
+
+// RetireBuild marks a build as retired, which tells every agent to remove its containers. The build itself is kept
+// for its history until it is built again
+func (client *EtcdClient) RetireBuild(ctx context.Context, key string) error {
+	_, err := client.client.Put(ctx, "echocicd/builds/"+key+"/retired", strconv.FormatInt(time.Now().UnixMilli(), 10))
 	if err != nil {
-		return fmt.Errorf("failed to serialise exec config: %w", err)
+		return fmt.Errorf("failed to retire build %v: %w", key, err)
 	}
+	return nil
+}
 
-	safeRepo := strings.ReplaceAll(repo, "/", "__")
+// Undeploy stops a project on every agent by retiring its build, and marks it as stopped so later builds are not
+// deployed until it is restored. Purging images also has the agents remove the image of the build, and purging history
+// forgets every build that was published for the project
+func (client *EtcdClient) Undeploy(ctx context.Context, key string, purgeHistory bool, purgeImages bool) error {
+	_, err := client.GetStoredConfig(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not find a published build for %v: %w", key, err)
+	}
 
-	return errors.Join(
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/name", safeRepo), name)),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/version", safeRepo), hash)),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/repo", safeRepo), repo)),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/timestamp", safeRepo), strconv.FormatInt(time.Now().UnixMilli(), 10))),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/tag", safeRepo), tag)),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/registry", safeRepo), registry)),
-		CollapseToErr(client.client.Put(context.Background(), fmt.Sprintf("echocicd/builds/%v/exec", safeRepo), string(j))),
-	)
+	_, err = client.client.Put(ctx, "echocicd/stopped/"+key, strconv.FormatInt(time.Now().UnixMilli(), 10))
+	if err != nil {
+		return fmt.Errorf("failed to mark %v as stopped: %w", key, err)
+	}
+
+	// The purge flag has to be in place before the build is retired, agents read it alongside the retirement
+	if purgeImages {
+		_, err = client.client.Put(ctx, "echocicd/builds/"+key+"/purge", "images")
+		if err != nil {
+			return fmt.Errorf("failed to mark images of %v for removal: %w", key, err)
+		}
+	}
+
+	if err = client.RetireBuild(ctx, key); err != nil {
+		return err
+	}
+
+	if purgeHistory {
+		_, err = client.client.Delete(ctx, "echocicd/history/"+key+"/", etcd.WithPrefix())
+		if err != nil {
+			return fmt.Errorf("failed to purge history of %v: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// IsStopped returns true if the project has been undeployed and not restored since
+func (client *EtcdClient) IsStopped(ctx context.Context, key string) (bool, error) {
+	entries, err := client.client.Get(ctx, "echocicd/stopped/"+key, etcd.WithCountOnly())
+	if err != nil {
+		return false, fmt.Errorf("failed to query whether %v is stopped: %w", key, err)
+	}
+	return entries.Count > 0, nil
+}
+
+// Restore allows a project which was undeployed to be deployed again, starting with its next build
+func (client *EtcdClient) Restore(ctx context.Context, key string) error {
+	response, err := client.client.Delete(ctx, "echocicd/stopped/"+key)
+	if err != nil {
+		return fmt.Errorf("failed to restore %v: %w", key, err)
+	}
+	if response.Deleted == 0 {
+		return fmt.Errorf("%v has not been undeployed", key)
+	}
+	return nil
+}
+
+// RetireBuildsForRef retires every build of the repo made from the ref, used when a branch is deleted
+func (client *EtcdClient) RetireBuildsForRef(ctx context.Context, repo string, ref string) error {
+	return client.retireMatching(ctx, func(build PublishedBuild) bool {
+		return build.Repo == repo && build.Ref == ref
+	})
+}
+
+// RetireRepository retires every build of the repo and forgets its previews, used when a repository is deleted or
+// archived
+func (client *EtcdClient) RetireRepository(ctx context.Context, repo string) error {
+	previews, err := client.ListPreviews(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, preview := range previews {
+		if preview.Repo == repo {
+			errs = append(errs, CollapseToErr(client.client.Delete(ctx, "echocicd/previews/"+preview.Key)))
+		}
+	}
+
+	errs = append(errs, client.retireMatching(ctx, func(build PublishedBuild) bool {
+		return build.Repo == repo
+	}))
+	return errors.Join(errs...)
+}
+
+func (client *EtcdClient) retireMatching(ctx context.Context, matches func(build PublishedBuild) bool) error {
+	builds, err := client.ListStoredConfigs(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, build := range builds {
+		if build.Retired == 0 && matches(build) {
+			slog.Info("retiring build", "key", build.Key, "name", build.Name, "ref", build.Ref)
+			errs = append(errs, client.RetireBuild(ctx, build.Key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DeploymentStatus is written by each agent after it attempts to deploy a build. Pending is the version held back while
+// the project is frozen or outside its deploy window, and ScheduledFor is the unix milliseconds at which a build
+// queued for its deploy window will be deployed
+type DeploymentStatus struct {
+	Agent        string   `json:"agent"`
+	Project      string   `json:"project"`
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	State        string   `json:"state"`
+	Pending      string   `json:"pending,omitempty"`
+	ScheduledFor int64    `json:"scheduledFor,omitempty"`
+	ContainerId  string   `json:"containerId,omitempty"`
+	ContainerIds []string `json:"containerIds,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Timestamp    int64    `json:"timestamp"`
+}
+
+func (client *EtcdClient) WriteDeploymentStatus(ctx context.Context, status DeploymentStatus) error {
+	status.Timestamp = time.Now().UnixMilli()
+
+	j, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to serialise deployment status: %w", err)
+	}
+
+	_, err = client.client.Put(ctx, fmt.Sprintf("echocicd/agents/%v/deployments/%v", status.Agent, status.Project), string(j))
+	return err
+}
+
+// GetDeploymentStatus returns the status an agent last reported for a project, or nil if it never reported one
+func (client *EtcdClient) GetDeploymentStatus(ctx context.Context, agent string, project string) (*DeploymentStatus, error) {
+	entries, err := client.client.Get(ctx, fmt.Sprintf("echocicd/agents/%v/deployments/%v", agent, project))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for deployment: %w", err)
+	}
+	if len(entries.Kvs) == 0 {
+		return nil, nil
+	}
+
+	var status DeploymentStatus
+	err = json.Unmarshal(entries.Kvs[0].Value, &status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse deployment status: %w", err)
+	}
+	return &status, nil
+}
+
+// ListDeploymentStatuses returns the status reported by every agent, optionally filtered to a single project
+func (client *EtcdClient) ListDeploymentStatuses(ctx context.Context, project string) ([]DeploymentStatus, error) {
+	entries, err := client.client.Get(ctx, "echocicd/agents/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for deployments: %w", err)
+	}
+
+	result := make([]DeploymentStatus, 0)
+	for _, kv := range entries.Kvs {
+		if !strings.Contains(string(kv.Key), "/deployments/") {
+			continue
+		}
+
+		var status DeploymentStatus
+		err = json.Unmarshal(kv.Value, &status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse deployment status %v: %w", string(kv.Key), err)
+		}
+
+		if project == "" || status.Project == project {
+			result = append(result, status)
+		}
+	}
+
+	return result, nil
+}
+
+func (client *EtcdClient) WriteBuildInfo(repo string, environment string, ref string, name string, hash string, tag string, digest string, registry string, config configs.ExecProperties, ignoreWindow bool) error {
+	slog.Info("writing", "repo", repo, "environment", environment, "ref", ref, "name", name, "hash", hash, "tag", tag, "digest", digest, "registry", registry, "client", client)
+
+	build := PublishedBuild{
+		Key:          DeploymentKey(repo, environment),
+		Name:         name,
+		Repo:         repo,
+		Environment:  environment,
+		Ref:          ref,
+		Version:      hash,
+		Timestamp:    int(time.Now().UnixMilli()),
+		Tag:          tag,
+		Digest:       digest,
+		Registry:     registry,
+		Exec:         config,
+		IgnoreWindow: ignoreWindow,
+	}
+
+	return client.SubmitBuild(context.Background(), build)
+}
+
+// SubmitBuild records a build in the history of its project and publishes it to the agents, unless its exec config
+// requires approval in which case it waits for approval instead
+func (client *EtcdClient) SubmitBuild(ctx context.Context, build PublishedBuild) error {
+	history, err := client.writeHistory(ctx, build)
+	if err != nil {
+		return err
+	}
+
+	// Builds of a stopped project are kept in its history but never deployed or offered for approval
+	stopped, err := client.IsStopped(ctx, build.Key)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return fmt.Errorf("%w: %v", ErrProjectStopped, build.Key)
+	}
+
+	// Builds that need approval wait under echocicd/pending until someone approves them
+	if build.Exec.Approval == configs.ApprovalManual {
+		_, err = client.client.Put(ctx, "echocicd/pending/"+build.Key, history)
+		if err != nil {
+			return fmt.Errorf("failed to write pending build: %w", err)
+		}
+		return nil
+	}
+
+	return client.publishBuild(ctx, build)
+}
+
+// PublishBuild records a build in the history of its project and publishes it straight to the agents, skipping any
+// approval
+func (client *EtcdClient) PublishBuild(ctx context.Context, build PublishedBuild) error {
+	if _, err := client.writeHistory(ctx, build); err != nil {
+		return err
+	}
+	return client.publishBuild(ctx, build)
+}
+
+// writeHistory adds the build to the history of its project, returning the serialised build
+func (client *EtcdClient) writeHistory(ctx context.Context, build PublishedBuild) (string, error) {
+	history, err := json.Marshal(build)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialise history entry: %w", err)
+	}
+
+	_, err = client.client.Put(ctx, fmt.Sprintf("echocicd/history/%v/%013d-%v", build.Key, build.Timestamp, build.Version), string(history))
+	if err != nil {
+		return "", fmt.Errorf("failed to write history entry: %w", err)
+	}
+	return string(history), nil
+}
+
+// publishBuild writes the keys of a build which agents deploy in a single transaction. Builds of a stopped project are
+// refused
+func (client *EtcdClient) publishBuild(ctx context.Context, build PublishedBuild) error {
+	ops, err := publishOps(build)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.client.Txn(ctx).If(notStopped(build.Key)).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("failed to publish build: %w", err)
+	}
+	if !response.Succeeded {
+		return fmt.Errorf("%w: %v", ErrProjectStopped, build.Key)
+	}
+	return nil
+}
+
+// notStopped holds while the project has not been undeployed
+func notStopped(key string) etcd.Cmp {
+	return etcd.Compare(etcd.CreateRevision("echocicd/stopped/"+key), "=", 0)
+}
+
+// publishOps are the writes which publish a build, finishing with the exec config which agents watch for
+func publishOps(build PublishedBuild) ([]etcd.Op, error) {
+	j, err := json.Marshal(build.Exec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialise exec config: %w", err)
+	}
+
+	key := build.Key
+	return []etcd.Op{
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/name", key), build.Name),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/version", key), build.Version),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/repo", key), build.Repo),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/environment", key), build.Environment),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/ref", key), build.Ref),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/timestamp", key), strconv.Itoa(build.Timestamp)),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/tag", key), build.Tag),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/digest", key), build.Digest),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/registry", key), build.Registry),
+		// A new build brings a retired project back
+		etcd.OpDelete(fmt.Sprintf("echocicd/builds/%v/retired", key)),
+		etcd.OpDelete(fmt.Sprintf("echocicd/builds/%v/purge", key)),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/ignore-window", key), strconv.FormatBool(build.IgnoreWindow)),
+		etcd.OpPut(fmt.Sprintf("echocicd/builds/%v/exec", key), string(j)),
+	}, nil
 }
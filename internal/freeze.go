@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// FreezeRecord is stored while a project is frozen. Builds keep being published but agents hold off deploying them
+// until the project is unfrozen
+type FreezeRecord struct {
+	Key       string `json:"key"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Freeze stops agents deploying new builds of the project until it is unfrozen
+func (client *EtcdClient) Freeze(ctx context.Context, key string, reason string) error {
+	j, err := json.Marshal(FreezeRecord{Key: key, Reason: reason, Timestamp: time.Now().UnixMilli()})
+	if err != nil {
+		return fmt.Errorf("failed to serialise freeze: %w", err)
+	}
+
+	_, err = client.client.Put(ctx, "echocicd/frozen/"+key, string(j))
+	if err != nil {
+		return fmt.Errorf("failed to freeze %v: %w", key, err)
+	}
+	return nil
+}
+
+// Unfreeze lets agents deploy the project again, each deploying the latest build if it was held back
+func (client *EtcdClient) Unfreeze(ctx context.Context, key string) error {
+	response, err := client.client.Delete(ctx, "echocicd/frozen/"+key)
+	if err != nil {
+		return fmt.Errorf("failed to unfreeze %v: %w", key, err)
+	}
+	if response.Deleted == 0 {
+		return fmt.Errorf("%v is not frozen", key)
+	}
+	return nil
+}
+
+// GetFreeze returns the freeze on a project, or nil if it is not frozen
+func (client *EtcdClient) GetFreeze(ctx context.Context, key string) (*FreezeRecord, error) {
+	entries, err := client.client.Get(ctx, "echocicd/frozen/"+key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for freeze: %w", err)
+	}
+	if len(entries.Kvs) == 0 {
+		return nil, nil
+	}
+
+	var record FreezeRecord
+	err = json.Unmarshal(entries.Kvs[0].Value, &record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse freeze of %v: %w", key, err)
+	}
+	return &record, nil
+}
+
+// ListFreezes returns the freeze on every frozen project
+func (client *EtcdClient) ListFreezes(ctx context.Context) ([]FreezeRecord, error) {
+	entries, err := client.client.Get(ctx, "echocicd/frozen/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for freezes: %w", err)
+	}
+
+	result := make([]FreezeRecord, 0, len(entries.Kvs))
+	for _, kv := range entries.Kvs {
+		var record FreezeRecord
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse freeze %v: %w", string(kv.Key), err)
+		}
+		result = append(result, record)
+	}
+
+	return result, nil
+}
+
+// WatchForUnfrozen calls the handler with the key of every project which is unfrozen
+func (client *EtcdClient) WatchForUnfrozen(ctx context.Context, handler func(key string)) {
+	watcher := client.client.Watch(ctx, "echocicd/frozen/", etcd.WithPrefix())
+	for {
+		select {
+		case event := <-watcher:
+			for _, e := range event.Events {
+				if e.Type == mvccpb.DELETE {
+					slog.Debug("found an unfrozen project", "event", e)
+					handler(strings.TrimPrefix(string(e.Kv.Key), "echocicd/frozen/"))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
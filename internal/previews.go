@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	etcd "go.etcd.io/etcd/client/v3"
+	"log/slog"
+	"time"
+)
+
+// PreviewRecord is stored for every preview deployment so it can be torn down when its branch is deleted or it has
+// not been pushed to within its ttl
+type PreviewRecord struct {
+	Key          string `json:"key"`
+	Repo         string `json:"repo"`
+	Ref          string `json:"ref"`
+	Name         string `json:"name"`
+	Ttl          int64  `json:"ttl"`
+	LastActivity int64  `json:"lastActivity"`
+}
+
+// Expired returns true if the preview has not been pushed to within its ttl
+func (record PreviewRecord) Expired(now time.Time) bool {
+	return now.UnixMilli() > record.LastActivity+record.Ttl
+}
+
+// TouchPreview records activity on a preview, creating the record if this is its first build
+func (client *EtcdClient) TouchPreview(ctx context.Context, record PreviewRecord) error {
+	record.LastActivity = time.Now().UnixMilli()
+
+	j, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to serialise preview: %w", err)
+	}
+
+	_, err = client.client.Put(ctx, "echocicd/previews/"+record.Key, string(j))
+	if err != nil {
+		return fmt.Errorf("failed to store preview: %w", err)
+	}
+	return nil
+}
+
+func (client *EtcdClient) ListPreviews(ctx context.Context) ([]PreviewRecord, error) {
+	entries, err := client.client.Get(ctx, "echocicd/previews/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for previews: %w", err)
+	}
+
+	result := make([]PreviewRecord, 0, len(entries.Kvs))
+	for _, kv := range entries.Kvs {
+		var record PreviewRecord
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse preview %v: %w", string(kv.Key), err)
+		}
+		result = append(result, record)
+	}
+
+	return result, nil
+}
+
+// TeardownPreview retires the preview's build and forgets about the preview
+func (client *EtcdClient) TeardownPreview(ctx context.Context, record PreviewRecord) error {
+	return errors.Join(
+		client.RetireBuild(ctx, record.Key),
+		CollapseToErr(client.client.Delete(ctx, "echocicd/previews/"+record.Key)),
+	)
+}
+
+// TeardownPreviewsForRef tears down every preview built from the ref of the repo, used when a branch is deleted
+func (client *EtcdClient) TeardownPreviewsForRef(ctx context.Context, repo string, ref string) error {
+	previews, err := client.ListPreviews(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, preview := range previews {
+		if preview.Repo == repo && preview.Ref == ref {
+			slog.Info("tearing down preview as its branch was deleted", "name", preview.Name, "ref", ref)
+			errs = append(errs, client.TeardownPreview(ctx, preview))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LaunchPreviewReaper tears down previews which have not been pushed to within their ttl until the context is cancelled
+func LaunchPreviewReaper(ctx context.Context, client *EtcdClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			previews, err := client.ListPreviews(ctx)
+			if err != nil {
+				slog.Error("failed to list previews", "err", err)
+				continue
+			}
+
+			for _, preview := range previews {
+				if !preview.Expired(now) {
+					continue
+				}
+				slog.Info("tearing down inactive preview", "name", preview.Name, "ref", preview.Ref)
+				if err = client.TeardownPreview(ctx, preview); err != nil {
+					slog.Error("failed to tear down preview", "name", preview.Name, "err", err)
+				}
+			}
+		}
+	}
+}
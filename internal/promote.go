@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"echo-cicd/configs"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// PromoteOptions describes copying the published build of one environment of a repo to another. Name and Exec are the
+// target's name and exec config, which default to those of the target's last build when not set
+type PromoteOptions struct {
+	Repo string
+	From string
+	To   string
+	Name string
+	Exec *configs.ExecProperties
+	// Retag pushes the image under the target's name as well, otherwise the target deploys the source's image as is
+	Retag bool
+	// SkipApproval publishes the build straight away even if the target requires approval
+	SkipApproval bool
+}
+
+// Promote publishes the image built for one environment to another without rebuilding it, so the target deploys the
+// exact image that was verified. Only the image is copied, the target keeps its own name and exec config, so if the
+// target requires approval the promoted build waits for it
+func Promote(ctx context.Context, client *EtcdClient, conn *docker.Client, auths *RegistryAuths, options PromoteOptions, output io.Writer) (*PublishedBuild, error) {
+	if options.From == options.To {
+		return nil, fmt.Errorf("cannot promote %v to itself", DeploymentKey(options.Repo, options.From))
+	}
+
+	source, err := client.GetStoredConfig(ctx, DeploymentKey(options.Repo, options.From))
+	if err != nil {
+		return nil, fmt.Errorf("could not find a published build for %v: %w", DeploymentKey(options.Repo, options.From), err)
+	}
+	if source.Retired != 0 {
+		return nil, fmt.Errorf("the build of %v has been retired", source.Key)
+	}
+
+	build := *source
+	build.Key = DeploymentKey(options.Repo, options.To)
+	build.Environment = options.To
+	build.Timestamp = int(time.Now().UnixMilli())
+	build.Retired, build.PurgeImages, build.IgnoreWindow = 0, false, false
+
+	target, err := client.GetStoredConfig(ctx, build.Key)
+	if err != nil && !errors.Is(err, ErrBuildNotFound) {
+		return nil, fmt.Errorf("failed to load the build of %v: %w", build.Key, err)
+	}
+
+	// The target keeps the ref it was built from, deleting the source's branch must not retire it. A target which has
+	// never been built has no ref, so it is never retired by a branch being deleted
+	build.Ref = ""
+	if target != nil {
+		build.Ref = target.Ref
+	}
+
+	if options.Name == "" || options.Exec == nil {
+		if target == nil {
+			return nil, fmt.Errorf("%v has never been built so its name and exec config are unknown, pass its deploy config", build.Key)
+		}
+		if options.Name == "" {
+			options.Name = target.Name
+		}
+		if options.Exec == nil {
+			options.Exec = &target.Exec
+		}
+	}
+	build.Name, build.Exec = options.Name, *options.Exec
+
+	if options.Retag {
+		if source.Registry == "" {
+			return nil, fmt.Errorf("the build of %v was not pushed to a registry so cannot be retagged", source.Key)
+		}
+		build.Tag, build.Digest, err = retagImage(ctx, conn, auths, *source, source.Registry+"/"+build.Name+":"+build.Version, output)
+		if err != nil {
+			return nil, err
+		}
+		if source.Digest != "" && build.Digest != source.Digest {
+			return nil, fmt.Errorf("retagged image has digest %v rather than %v, refusing to promote a different image", build.Digest, source.Digest)
+		}
+	}
+
+	if options.SkipApproval {
+		err = client.PublishBuild(ctx, build)
+	} else {
+		err = client.SubmitBuild(ctx, build)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish promoted build: %w", err)
+	}
+
+	slog.Info("promoted build", "from", source.Key, "to", build.Key, "version", build.Version, "tag", build.Tag)
+	return &build, nil
+}
+
+// retagImage pulls the image of a build and pushes it under a new tag, returning the tag and the digest the registry
+// reports for it
+func retagImage(ctx context.Context, conn *docker.Client, auths *RegistryAuths, build PublishedBuild, tag string, output io.Writer) (string, string, error) {
+	image, err := ImageReference(build)
+	if err != nil {
+		return "", "", err
+	}
+
+	pullAuth, err := auths.For(image)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve registry credentials: %w", err)
+	}
+
+	err = RetryRegistry(ctx, "pull "+image, func() error {
+		response, err := conn.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: pullAuth})
+		if err != nil {
+			return err
+		}
+		return ScanForDockerError(response, output)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to pull docker image: %w", err)
+	}
+
+	err = conn.ImageTag(ctx, image, tag)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to tag %v as %v: %w", image, tag, err)
+	}
+
+	pushAuth, err := auths.For(tag)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve registry credentials: %w", err)
+	}
+
+	digest := ""
+	err = RetryRegistry(ctx, "push "+tag, func() error {
+		response, err := conn.ImagePush(ctx, tag, types.ImagePushOptions{RegistryAuth: pushAuth})
+		if err != nil {
+			return fmt.Errorf("failed to push image %v to registry: %w", tag, err)
+		}
+
+		digest, err = ScanForPushDigest(response, output)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if digest == "" {
+		return "", "", fmt.Errorf("registry did not report a digest for %v", tag)
+	}
+
+	return tag, digest, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"echo-cicd/configs"
+	"io"
+	"testing"
+)
+
+func TestPromoteRespectsApproval(t *testing.T) {
+	ctx := context.Background()
+	client := newTestEtcd(t)
+
+	builds := []PublishedBuild{
+		{Key: DeploymentKey("ryan/app", "staging"), Name: "app-staging", Repo: "ryan/app", Environment: "staging", Ref: "refs/heads/staging", Version: "bbbbbbb", Timestamp: 2},
+		{Key: DeploymentKey("ryan/app", "prod"), Name: "app", Repo: "ryan/app", Environment: "prod", Ref: "refs/heads/main", Version: "aaaaaaa", Timestamp: 1, Exec: configs.ExecProperties{Approval: configs.ApprovalManual}},
+	}
+	for _, build := range builds {
+		if err := client.PublishBuild(ctx, build); err != nil {
+			t.Fatalf("failed to publish build: %v", err)
+		}
+	}
+
+	options := PromoteOptions{Repo: "ryan/app", From: "staging", To: "prod"}
+	if _, err := Promote(ctx, client, nil, nil, options, io.Discard); err != nil {
+		t.Fatalf("failed to promote: %v", err)
+	}
+
+	pending, err := client.GetPendingBuild(ctx, builds[1].Key)
+	if err != nil {
+		t.Fatalf("failed to load pending build: %v", err)
+	}
+	if pending == nil || pending.Version != "bbbbbbb" || pending.Name != "app" {
+		t.Fatalf("expected the promoted build to wait for approval, got %+v", pending)
+	}
+	deployed, err := client.GetStoredConfig(ctx, builds[1].Key)
+	if err != nil {
+		t.Fatalf("failed to load target: %v", err)
+	}
+	if deployed.Version != "aaaaaaa" {
+		t.Fatalf("expected the target to keep running aaaaaaa until approved, got %v", deployed.Version)
+	}
+
+	options.SkipApproval = true
+	if _, err = Promote(ctx, client, nil, nil, options, io.Discard); err != nil {
+		t.Fatalf("failed to promote: %v", err)
+	}
+	if deployed, err = client.GetStoredConfig(ctx, builds[1].Key); err != nil || deployed.Version != "bbbbbbb" {
+		t.Fatalf("expected --skip-approval to publish bbbbbbb, got %+v: %v", deployed, err)
+	}
+
+	// Deleting the branch staging was built from retires staging but not what was promoted from it
+	if err = client.RetireBuildsForRef(ctx, "ryan/app", "refs/heads/staging"); err != nil {
+		t.Fatalf("failed to retire staging: %v", err)
+	}
+	for _, build := range builds {
+		stored, err := client.GetStoredConfig(ctx, build.Key)
+		if err != nil {
+			t.Fatalf("failed to load %v: %v", build.Key, err)
+		}
+		if retired := stored.Retired != 0; retired != (build.Environment == "staging") {
+			t.Errorf("expected only staging to be retired, %v has retired %v", build.Key, stored.Retired)
+		}
+	}
+}
+
+func TestPromoteToNewEnvironmentHasNoRef(t *testing.T) {
+	ctx := context.Background()
+	client := newTestEtcd(t)
+
+	source := PublishedBuild{Key: DeploymentKey("ryan/app", "staging"), Name: "app-staging", Repo: "ryan/app", Environment: "staging", Ref: "refs/heads/staging", Version: "bbbbbbb"}
+	if err := client.PublishBuild(ctx, source); err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+
+	options := PromoteOptions{Repo: "ryan/app", From: "staging", To: "prod"}
+	if _, err := Promote(ctx, client, nil, nil, options, io.Discard); err == nil {
+		t.Fatalf("expected promoting to an environment that was never built without its config to fail")
+	}
+
+	options.Name, options.Exec = "app", &configs.ExecProperties{}
+	build, err := Promote(ctx, client, nil, nil, options, io.Discard)
+	if err != nil {
+		t.Fatalf("failed to promote: %v", err)
+	}
+	if build.Ref != "" {
+		t.Fatalf("expected a promoted build without a previous target to have no ref, got %v", build.Ref)
+	}
+}
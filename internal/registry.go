@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"echo-cicd/util"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	registryAttempts     = 5
+	registryInitialDelay = 2 * time.Second
+	registryMaxDelay     = 30 * time.Second
+)
+
+// dockerHubAuthKey is the key docker uses for Docker Hub in config.json rather than the registry host
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// DockerConfig is the subset of ~/.docker/config.json used to find registry credentials
+type DockerConfig struct {
+	Auths       map[string]DockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type DockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// DefaultDockerConfigPath follows the docker cli, preferring $DOCKER_CONFIG over ~/.docker
+func DefaultDockerConfigPath() string {
+	if dir, ok := os.LookupEnv("DOCKER_CONFIG"); ok {
+		return path.Join(dir, "config.json")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".docker", "config.json")
+}
+
+// LoadDockerConfig reads a docker config.json, a missing file is treated as having no credentials
+func LoadDockerConfig(file string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	if file == "" {
+		return config, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Info("docker config does not exist, registries will be accessed anonymously", "path", file)
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read docker config: %w", err)
+	}
+
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse docker config: %w", err)
+	}
+
+	return config, nil
+}
+
+// Credentials returns the credentials for a registry host, checking credential helpers, then inline auths, then the
+// default credential store. If nothing is configured for the host an empty config is returned
+func (config *DockerConfig) Credentials(host string) (registry.AuthConfig, error) {
+	key := host
+	if host == "docker.io" || host == "index.docker.io" {
+		key = dockerHubAuthKey
+	}
+
+	if helper, ok := config.CredHelpers[host]; ok {
+		return credentialsFromHelper(helper, key)
+	}
+
+	if auth, ok := config.Auths[key]; ok {
+		result := registry.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: key,
+		}
+
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return registry.AuthConfig{}, fmt.Errorf("failed to decode auth for %v: %w", host, err)
+			}
+			result.Username, result.Password, _ = strings.Cut(string(decoded), ":")
+		}
+
+		return result, nil
+	}
+
+	if config.CredsStore != "" {
+		return credentialsFromHelper(config.CredsStore, key)
+	}
+
+	return registry.AuthConfig{ServerAddress: key}, nil
+}
+
+// credentialsFromHelper runs docker-credential-<helper> get, as described by the docker credential helper protocol
+func credentialsFromHelper(helper string, serverUrl string) (registry.AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	command := exec.Command("docker-credential-"+helper, "get")
+	command.Stdin = strings.NewReader(serverUrl)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	err := command.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return registry.AuthConfig{ServerAddress: serverUrl}, nil
+		}
+		return registry.AuthConfig{}, fmt.Errorf("credential helper %v failed: %v: %w", helper, message, err)
+	}
+
+	var response struct {
+		ServerURL string `json:"ServerURL"`
+		Username  string `json:"Username"`
+		Secret    string `json:"Secret"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &response)
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("failed to parse response from credential helper %v: %w", helper, err)
+	}
+
+	// Helpers return identity tokens with this placeholder username
+	if response.Username == "<token>" {
+		return registry.AuthConfig{IdentityToken: response.Secret, ServerAddress: serverUrl}, nil
+	}
+
+	return registry.AuthConfig{Username: response.Username, Password: response.Secret, ServerAddress: serverUrl}, nil
+}
+
+// RegistryAuths resolves the encoded RegistryAuth docker expects when pushing or pulling an image
+type RegistryAuths struct {
+	// Override is used for every registry if set, this is the pre-encoded value from --push-auth or PUSH_AUTH
+	Override *string
+	Config   *DockerConfig
+}
+
+func (auths *RegistryAuths) For(image string) (string, error) {
+	if auths == nil {
+		return "", nil
+	}
+
+	if auths.Override != nil {
+		return *auths.Override, nil
+	}
+
+	if auths.Config == nil {
+		return "", nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image %v: %w", image, err)
+	}
+
+	credentials, err := auths.Config.Credentials(reference.Domain(named))
+	if err != nil {
+		return "", err
+	}
+
+	if credentials.Username == "" && credentials.Password == "" && credentials.IdentityToken == "" {
+		return "", nil
+	}
+
+	return registry.EncodeAuthConfig(credentials)
+}
+
+// isTransientRegistryError returns false for errors that will not be fixed by trying again
+func isTransientRegistryError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, permanent := range []string{"unauthorized", "denied", "manifest unknown", "not found", "invalid reference"} {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RetryRegistry retries a push or pull with exponential backoff while it fails with transient errors
+func RetryRegistry(ctx context.Context, description string, operation func() error) error {
+	attempt := 0
+	return util.Retry(ctx, registryAttempts, registryInitialDelay, registryMaxDelay, isTransientRegistryError, func() error {
+		attempt++
+		err := operation()
+		if err != nil && attempt < registryAttempts && isTransientRegistryError(err) {
+			slog.Warn("registry operation failed, retrying", "operation", description, "attempt", attempt, "err", err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"echo-cicd/configs"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// replicaSettleTime is how long a new replica has to keep running before the next replica is replaced
+var replicaSettleTime = 5 * time.Second
+
+// DeployReplicas replaces the replicas of a project with the build one at a time, so the rest keep serving while each
+// is replaced. If a replica fails to start the roll stops there, leaving the remaining replicas on the old build. The
+// ids of the containers that were started are returned in replica order
+func DeployReplicas(build PublishedBuild, conn *docker.Client, registryAuths *RegistryAuths) ([]string, error) {
+	count := max(build.Exec.Replicas, 1)
+
+	// Every replica's ports are picked up front so the domain label on each lists the host port of them all
+	routed := ""
+	if build.Exec.Domain != nil {
+		routed = build.Exec.Domain.ContainerPort
+		if routed == "" {
+			routed = configs.PortForDomain(build.Exec.Ports, build.Exec.Domain.Port)
+		}
+	}
+
+	execs := make([]configs.ExecProperties, count)
+	upstreams := make([]int, 0, count)
+	for i := range execs {
+		exec, err := AllocateHostPorts(build.Exec, i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate ports for replica %d: %w", i, err)
+		}
+		execs[i] = exec
+		if host, ok := exec.Ports[routed]; ok {
+			upstreams = append(upstreams, host)
+		}
+	}
+
+	existing, err := listManagedContainers("echo-project="+build.Name, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, count)
+	for i, exec := range execs {
+		// Containers started before the project had replicas have no index and are replaced by the first replica
+		replaced := slices.DeleteFunc(slices.Clone(existing), func(t types.Container) bool {
+			index, ok := t.Labels["echo-replica"]
+			return index != strconv.Itoa(i) && (ok || i != 0)
+		})
+		if err = removeContainers(replaced, conn); err != nil {
+			return ids, fmt.Errorf("failed to remove replica %d: %w", i, err)
+		}
+
+		id, err := RunReplica(build, i, exec, upstreams, conn, registryAuths)
+		if err != nil {
+			return ids, fmt.Errorf("failed to start replica %d: %w", i, err)
+		}
+		ids = append(ids, *id)
+		slog.Info("replica launched", "name", build.Name, "version", build.Version, "replica", i, "id", *id)
+
+		if i < count-1 {
+			if err = waitForReplica(*id, conn); err != nil {
+				return ids, fmt.Errorf("replica %d did not stay up: %w", i, err)
+			}
+		}
+	}
+
+	// Replicas beyond the new count are no longer needed
+	surplus := slices.DeleteFunc(existing, func(t types.Container) bool {
+		index, err := strconv.Atoi(t.Labels["echo-replica"])
+		return err != nil || index < count
+	})
+	if err = removeContainers(surplus, conn); err != nil {
+		return ids, fmt.Errorf("failed to remove surplus replicas: %w", err)
+	}
+
+	return ids, nil
+}
+
+// waitForReplica waits for the settle time then checks the container is still running
+func waitForReplica(id string, conn *docker.Client) error {
+	time.Sleep(replicaSettleTime)
+
+	inspect, err := conn.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %v: %w", id, err)
+	}
+	if inspect.State == nil || !inspect.State.Running {
+		return fmt.Errorf("container %v is not running", id)
+	}
+	return nil
+}
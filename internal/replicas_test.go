@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"echo-cicd/configs"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker is the part of the docker engine API used to run replicas, recording each change it makes to containers
+type fakeDocker struct {
+	lock       sync.Mutex
+	containers []types.Container
+	events     []string
+	// created holds the labels and published host port of each container created, by id
+	created map[string]createdContainer
+	// crashReplica is the replica whose new container exits straight after it starts
+	crashReplica string
+}
+
+type createdContainer struct {
+	Labels     map[string]string
+	HostConfig struct {
+		PortBindings map[string][]struct{ HostPort string }
+	}
+}
+
+var apiVersion = regexp.MustCompile(`^/v[0-9.]+`)
+
+func newFakeDocker(t *testing.T, existing ...types.Container) (*fakeDocker, *docker.Client) {
+	t.Helper()
+
+	fake := &fakeDocker{containers: existing, created: map[string]createdContainer{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	conn, err := docker.NewClientWithOpts(docker.WithHost("tcp://"+server.Listener.Addr().String()), docker.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("failed to create docker client: %v", err)
+	}
+	return fake, conn
+}
+
+func (fake *fakeDocker) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	path := apiVersion.ReplaceAllString(request.URL.Path, "")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case request.Method == http.MethodGet && path == "/containers/json":
+		var filters map[string]map[string]bool
+		_ = json.Unmarshal([]byte(request.URL.Query().Get("filters")), &filters)
+		matching := slices.DeleteFunc(slices.Clone(fake.containers), func(t types.Container) bool {
+			for label := range filters["label"] {
+				key, value, _ := strings.Cut(label, "=")
+				if t.Labels[key] != value {
+					return true
+				}
+			}
+			return false
+		})
+		_ = json.NewEncoder(writer).Encode(matching)
+	case request.Method == http.MethodGet && parts[0] == "images":
+		_ = json.NewEncoder(writer).Encode(map[string]any{"Id": "sha256:image", "Config": map[string]any{"Cmd": []string{"/app"}}})
+	case request.Method == http.MethodPost && path == "/containers/create":
+		var body createdContainer
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := "new-" + body.Labels["echo-replica"]
+		fake.created[id] = body
+		fake.containers = append(fake.containers, types.Container{ID: id, Labels: body.Labels, State: "created"})
+		fake.events = append(fake.events, "create "+id)
+		_ = json.NewEncoder(writer).Encode(map[string]any{"Id": id, "Warnings": []string{}})
+	case len(parts) >= 2 && parts[0] == "containers":
+		fake.serveContainer(writer, request.Method, parts[1], parts[2:])
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (fake *fakeDocker) serveContainer(writer http.ResponseWriter, method string, id string, action []string) {
+	index := slices.IndexFunc(fake.containers, func(t types.Container) bool { return t.ID == id })
+	if index < 0 {
+		http.Error(writer, `{"message": "no such container"}`, http.StatusNotFound)
+		return
+	}
+	container := &fake.containers[index]
+
+	switch {
+	case method == http.MethodPost && slices.Equal(action, []string{"start"}):
+		container.State = "running"
+		if container.Labels["echo-replica"] == fake.crashReplica {
+			container.State = "exited"
+		}
+		fake.events = append(fake.events, "start "+id)
+		writer.WriteHeader(http.StatusNoContent)
+	case method == http.MethodPost && slices.Equal(action, []string{"stop"}):
+		container.State = "exited"
+		fake.events = append(fake.events, "stop "+id)
+		writer.WriteHeader(http.StatusNoContent)
+	case method == http.MethodDelete && len(action) == 0:
+		fake.containers = slices.Delete(fake.containers, index, index+1)
+		fake.events = append(fake.events, "remove "+id)
+		writer.WriteHeader(http.StatusNoContent)
+	case method == http.MethodGet && slices.Equal(action, []string{"json"}):
+		fake.events = append(fake.events, "inspect "+id)
+		_ = json.NewEncoder(writer).Encode(map[string]any{
+			"Id":    id,
+			"State": map[string]any{"Status": container.State, "Running": container.State == "running"},
+		})
+	default:
+		http.NotFound(writer, nil)
+	}
+}
+
+func replicaContainer(id string, replica string) types.Container {
+	labels := map[string]string{"managed-by": "echocicd", "echo-project": "app"}
+	if replica != "" {
+		labels["echo-replica"] = replica
+	}
+	return types.Container{ID: id, Labels: labels, State: "running"}
+}
+
+func replicaBuild() PublishedBuild {
+	return PublishedBuild{
+		Key:     "ryan__app",
+		Name:    "app",
+		Version: "bbbbbbb",
+		Tag:     "registry.example.com/app:bbbbbbb",
+		Exec: configs.ExecProperties{
+			Ports:    map[string]int{"8080/tcp": 9000},
+			Domain:   &configs.DomainConfiguration{Port: 9000, Host: "app.example.com"},
+			Replicas: 3,
+		},
+	}
+}
+
+func withoutSettleTime(t *testing.T) {
+	previous := replicaSettleTime
+	replicaSettleTime = 0
+	t.Cleanup(func() { replicaSettleTime = previous })
+}
+
+func TestDeployReplicasRollsOneAtATime(t *testing.T) {
+	withoutSettleTime(t)
+	// A container from before the project had replicas, two old replicas and one more than the new count
+	fake, conn := newFakeDocker(t, replicaContainer("legacy", ""), replicaContainer("old-1", "1"), replicaContainer("old-2", "2"), replicaContainer("old-3", "3"))
+
+	ids, err := DeployReplicas(replicaBuild(), conn, nil)
+	if err != nil {
+		t.Fatalf("failed to deploy replicas: %v", err)
+	}
+	if !slices.Equal(ids, []string{"new-0", "new-1", "new-2"}) {
+		t.Fatalf("expected the ids of the new replicas in order, got %v", ids)
+	}
+
+	// Each replica is replaced and checked before the next one is touched, and the surplus goes last
+	expected := []string{
+		"stop legacy", "remove legacy", "create new-0", "start new-0", "inspect new-0",
+		"stop old-1", "remove old-1", "create new-1", "start new-1", "inspect new-1",
+		"stop old-2", "remove old-2", "create new-2", "start new-2",
+		"stop old-3", "remove old-3",
+	}
+	if !slices.Equal(fake.events, expected) {
+		t.Fatalf("expected the roll to go\n%v\ngot\n%v", expected, fake.events)
+	}
+
+	// Every replica has its own host port, and the domain of each lists them all
+	for i, id := range ids {
+		created := fake.created[id]
+		if bindings := created.HostConfig.PortBindings["8080/tcp"]; len(bindings) != 1 || bindings[0].HostPort != []string{"9000", "9001", "9002"}[i] {
+			t.Errorf("expected replica %v to publish 8080/tcp on 900%v, got %v", i, i, bindings)
+		}
+		if upstreams := created.Labels["domain:app.example.com"]; upstreams != "9000,9001,9002" {
+			t.Errorf("expected replica %v to route the domain to every replica, got %v", i, upstreams)
+		}
+	}
+}
+
+func TestDeployReplicasStopsWhenAReplicaFails(t *testing.T) {
+	withoutSettleTime(t)
+	fake, conn := newFakeDocker(t, replicaContainer("old-0", "0"), replicaContainer("old-1", "1"), replicaContainer("old-2", "2"))
+	fake.crashReplica = "1"
+
+	ids, err := DeployReplicas(replicaBuild(), conn, nil)
+	if err == nil || !strings.Contains(err.Error(), "replica 1 did not stay up") {
+		t.Fatalf("expected the roll to fail at replica 1, got %v", err)
+	}
+	if !slices.Equal(ids, []string{"new-0", "new-1"}) {
+		t.Fatalf("expected the replicas started before the failure to be returned, got %v", ids)
+	}
+
+	// The rest of the replicas are left on the old build
+	if last := fake.events[len(fake.events)-1]; last != "inspect new-1" {
+		t.Fatalf("expected the roll to stop once replica 1 failed, last did %v", last)
+	}
+	running := make([]string, 0)
+	for _, container := range fake.containers {
+		if container.State == "running" {
+			running = append(running, container.ID)
+		}
+	}
+	if !slices.Equal(running, []string{"old-2", "new-0"}) {
+		t.Fatalf("expected the old replica 2 to keep running alongside new replica 0, got %v", running)
+	}
+}
+
+func TestAllocateHostPorts(t *testing.T) {
+	exec := configs.ExecProperties{
+		Ports:  map[string]int{"8080/tcp": 9000, "9090/tcp": 0, "5353/udp": 0},
+		Domain: &configs.DomainConfiguration{Port: 9000, Host: "app.example.com"},
+	}
+
+	seen := map[int]bool{}
+	for replica := 0; replica < 3; replica++ {
+		allocated, err := AllocateHostPorts(exec, replica)
+		if err != nil {
+			t.Fatalf("failed to allocate ports for replica %v: %v", replica, err)
+		}
+		if allocated.Ports["8080/tcp"] != 9000+replica || allocated.Domain.Port != 9000+replica {
+			t.Errorf("expected replica %v to be on %v, got %v routed to %v", replica, 9000+replica, allocated.Ports, allocated.Domain.Port)
+		}
+		for _, port := range []string{"9090/tcp", "5353/udp"} {
+			if host := allocated.Ports[port]; host == 0 || seen[host] {
+				t.Errorf("expected %v of replica %v to get a free port of its own, got %v", port, replica, host)
+			}
+			seen[allocated.Ports[port]] = true
+		}
+	}
+
+	// The original config is left as it was
+	if exec.Ports["9090/tcp"] != 0 || exec.Domain.Port != 9000 {
+		t.Errorf("expected the exec config to be unchanged, got %+v", exec)
+	}
+
+	// Previews route to a container port, which follows wherever it was published
+	exec.Domain = &configs.DomainConfiguration{Host: "app.example.com", ContainerPort: "9090/tcp"}
+	allocated, err := AllocateHostPorts(exec, 1)
+	if err != nil {
+		t.Fatalf("failed to allocate ports: %v", err)
+	}
+	if allocated.Domain.Port != allocated.Ports["9090/tcp"] {
+		t.Errorf("expected the domain to route to the port 9090/tcp was published on, got %v", allocated.Domain.Port)
+	}
+}
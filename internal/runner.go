@@ -3,25 +3,42 @@ package internal
 import (
 	"echo-cicd/configs"
 	"fmt"
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	docker "github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	"github.com/opencontainers/go-digest"
 	"golang.org/x/net/context"
 	"log/slog"
+	"net"
+	"os"
 	"slices"
 	"strconv"
+	"strings"
 )
 
+// PublishedBuild is a build written to etcd for the agents. Environment is the [env.<name>] block of the deploy config
+// it was built for if any, Ref is the git ref that was built so the build can be retired when its branch is deleted,
+// and Retired is the unix milliseconds at which it was retired, after which every agent removes its containers and, if
+// PurgeImages is set, its image. IgnoreWindow deploys the build straight away even outside the exec deploy window
 type PublishedBuild struct {
-	Name      string
-	Version   string
-	Timestamp int
-	Tag       string
-	Registry  string
-	Exec      configs.ExecProperties
+	Key          string                 `json:"key"`
+	Name         string                 `json:"name"`
+	Repo         string                 `json:"repo,omitempty"`
+	Environment  string                 `json:"environment,omitempty"`
+	Ref          string                 `json:"ref,omitempty"`
+	Version      string                 `json:"version"`
+	Timestamp    int                    `json:"timestamp"`
+	Tag          string                 `json:"tag"`
+	Digest       string                 `json:"digest,omitempty"`
+	Registry     string                 `json:"registry"`
+	Exec         configs.ExecProperties `json:"exec"`
+	Retired      int64                  `json:"retired,omitempty"`
+	PurgeImages  bool                   `json:"purgeImages,omitempty"`
+	IgnoreWindow bool                   `json:"ignoreWindow,omitempty"`
 }
 
 func ConvertToPorts(ports map[string]int) nat.PortSet {
@@ -32,24 +49,150 @@ func ConvertToPorts(ports map[string]int) nat.PortSet {
 	return result
 }
 
+// AllocateHostPorts picks the host ports of a replica. Host ports of 0 are replaced with free ports on this host, and
+// fixed host ports are the start of a range with one port per replica. A domain that routes to a container port (as
+// previews do) or to a fixed host port is pointed at the host port the replica ended up on
+func AllocateHostPorts(exec configs.ExecProperties, replica int) (configs.ExecProperties, error) {
+	ports := make(map[string]int, len(exec.Ports))
+	for port, host := range exec.Ports {
+		if host == 0 {
+			free, err := freeHostPort(nat.Port(port).Proto())
+			if err != nil {
+				return exec, fmt.Errorf("failed to allocate a host port for %v: %w", port, err)
+			}
+			host = free
+		} else {
+			host += replica
+		}
+		ports[port] = host
+	}
+
+	if exec.Domain != nil {
+		domain := *exec.Domain
+		if domain.ContainerPort != "" {
+			host, ok := ports[domain.ContainerPort]
+			if !ok {
+				return exec, fmt.Errorf("the domain routes to port %v which is not published", domain.ContainerPort)
+			}
+			domain.Port = host
+		} else if port, ok := hostPortFor(exec.Ports, domain.Port); ok {
+			domain.Port = ports[port]
+		}
+		exec.Domain = &domain
+	}
+
+	exec.Ports = ports
+	return exec, nil
+}
+
+// hostPortFor finds the container port published on a fixed host port
+func hostPortFor(ports map[string]int, host int) (string, bool) {
+	for port, published := range ports {
+		if published != 0 && published == host {
+			return port, true
+		}
+	}
+	return "", false
+}
+
+func joinPorts(ports []int) string {
+	result := make([]string, 0, len(ports))
+	for _, port := range ports {
+		result = append(result, strconv.Itoa(port))
+	}
+	return strings.Join(result, ",")
+}
+
+// freeHostPort asks the kernel for a port that is currently free. Another process could take it before the container
+// starts, in which case the deploy fails and is reported in its deployment status
+func freeHostPort(proto string) (int, error) {
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// ConvertToEnv turns the exec env table into the KEY=value list docker expects, sorted so containers are comparable
+func ConvertToEnv(env map[string]string) []string {
+	result := make([]string, 0, len(env))
+	for k, v := range env {
+		result = append(result, k+"="+v)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// ImageReference returns the image to deploy for a build. Builds pushed to a registry are pinned to the digest
+// reported by the push so the agent runs exactly what was built, local builds fall back to the tag
+func ImageReference(build PublishedBuild) (string, error) {
+	if build.Digest == "" {
+		return build.Tag, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(build.Tag)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image tag %v: %w", build.Tag, err)
+	}
+
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), digest.Digest(build.Digest))
+	if err != nil {
+		return "", fmt.Errorf("failed to pin image to digest %v: %w", build.Digest, err)
+	}
+
+	return reference.FamiliarString(pinned), nil
+}
+
 func CleanupExistingContainers(name string, conn *docker.Client) error {
+	return cleanupContainers("echo-project="+name, conn)
+}
+
+// CleanupContainersForKey stops and removes the containers launched for a build key, used when the records of the build
+// have been deleted and its name is no longer known
+func CleanupContainersForKey(key string, conn *docker.Client) error {
+	return cleanupContainers("echo-key="+key, conn)
+}
+
+func cleanupContainers(label string, conn *docker.Client) error {
+	containers, err := listManagedContainers(label, conn)
+	if err != nil {
+		return err
+	}
+	return removeContainers(containers, conn)
+}
+
+// listManagedContainers lists the containers launched by an agent that carry the label
+func listManagedContainers(label string, conn *docker.Client) ([]types.Container, error) {
 	args := filters.NewArgs()
-	args.Add("label", "echo-project="+name)
+	args.Add("label", label)
 	args.Add("label", "managed-by=echocicd")
 	containers, err := conn.ContainerList(context.Background(), container.ListOptions{
 		All:     true,
 		Filters: args,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to list containers with filters: %w", err)
+		return nil, fmt.Errorf("failed to list containers with filters: %w", err)
 	}
+	return containers, nil
+}
 
+func removeContainers(containers []types.Container, conn *docker.Client) error {
 	timeout := 60
 
 	for _, t := range containers {
 		if t.State == "running" || t.State == "restarting" {
 			// Need to stop existing containers
-			err = conn.ContainerStop(context.Background(), t.ID, container.StopOptions{
+			err := conn.ContainerStop(context.Background(), t.ID, container.StopOptions{
 				Timeout: &timeout,
 			})
 			if err != nil {
@@ -69,26 +212,59 @@ func CleanupExistingContainers(name string, conn *docker.Client) error {
 	return nil
 }
 
-func RunContainer(build PublishedBuild, conn *docker.Client, registryAuths map[string]string) (*string, error) {
-	auth := ""
-	if v, ok := registryAuths[build.Registry]; ok {
-		auth = v
+// RemoveImage deletes the image of a build from the docker host, an image which is already gone is not an error
+func RemoveImage(build PublishedBuild, conn *docker.Client) error {
+	image, err := ImageReference(build)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ImageRemove(context.Background(), image, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	if err != nil && !docker.IsErrNotFound(err) {
+		return fmt.Errorf("failed to remove image %v: %w", image, err)
+	}
+	slog.Info("removed image", "image", image)
+	return nil
+}
+
+func RunContainer(build PublishedBuild, conn *docker.Client, registryAuths *RegistryAuths) (*string, error) {
+	exec, err := AllocateHostPorts(build.Exec, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	img, _, err := conn.ImageInspectWithRaw(context.Background(), build.Tag)
+	return RunReplica(build, 0, exec, nil, conn, registryAuths)
+}
+
+// RunReplica starts one replica of a build using an exec config from AllocateHostPorts. Upstreams are the host ports of
+// every replica the domain routes to, written to the domain label in place of the replica's own port
+func RunReplica(build PublishedBuild, replica int, exec configs.ExecProperties, upstreams []int, conn *docker.Client, registryAuths *RegistryAuths) (*string, error) {
+	image, err := ImageReference(build)
 	if err != nil {
-		slog.Info("could not find container with error, trying to pull", "err", err, "tag", build.Tag)
-		response, err := conn.ImagePull(context.Background(), build.Tag, types.ImagePullOptions{RegistryAuth: auth})
+		return nil, err
+	}
+
+	img, _, err := conn.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		slog.Info("could not find container with error, trying to pull", "err", err, "image", image)
+		auth, err := registryAuths.For(image)
 		if err != nil {
-			return nil, fmt.Errorf("failed to pull docker image: %w", err)
+			return nil, fmt.Errorf("failed to resolve registry credentials: %w", err)
 		}
 
-		err = ScanForDockerError(response)
+		err = RetryRegistry(context.Background(), "pull "+image, func() error {
+			response, err := conn.ImagePull(context.Background(), image, types.ImagePullOptions{RegistryAuth: auth})
+			if err != nil {
+				return err
+			}
+
+			return ScanForDockerError(response, os.Stdout)
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to pull docker image: %w", err)
 		}
 
-		img, _, err = conn.ImageInspectWithRaw(context.Background(), build.Tag)
+		img, _, err = conn.ImageInspectWithRaw(context.Background(), image)
 		if err != nil {
 			return nil, fmt.Errorf("could not inspect container: %w", err)
 		}
@@ -109,7 +285,7 @@ func RunContainer(build PublishedBuild, conn *docker.Client, registryAuths map[s
 	}
 
 	ports := map[nat.Port][]nat.PortBinding{}
-	for cnter, host := range build.Exec.Ports {
+	for cnter, host := range exec.Ports {
 		ports[nat.Port(cnter)] = []nat.PortBinding{
 			{
 				HostIP:   "0.0.0.0",
@@ -121,9 +297,14 @@ func RunContainer(build PublishedBuild, conn *docker.Client, registryAuths map[s
 	labels := map[string]string{
 		"managed-by":   "echocicd",
 		"echo-project": build.Name,
+		"echo-key":     build.Key,
+		"echo-replica": strconv.Itoa(replica),
 	}
-	if build.Exec.Domain != nil {
-		labels["domain:"+build.Exec.Domain.Host] = strconv.Itoa(build.Exec.Domain.Port)
+	if exec.Domain != nil {
+		labels["domain:"+exec.Domain.Host] = strconv.Itoa(exec.Domain.Port)
+		if len(upstreams) > 0 {
+			labels["domain:"+exec.Domain.Host] = joinPorts(upstreams)
+		}
 	}
 
 	create, err := conn.ContainerCreate(context.Background(), &container.Config{
@@ -133,6 +314,7 @@ func RunContainer(build PublishedBuild, conn *docker.Client, registryAuths map[s
 		ExposedPorts: ConvertToPorts(build.Exec.Ports),
 		Volumes:      map[string]struct{}{},
 		Cmd:          command,
+		Env:          ConvertToEnv(build.Exec.Env),
 		Image:        img.ID,
 		Labels:       labels,
 	}, &container.HostConfig{
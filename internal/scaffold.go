@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-git/v5"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ScaffoldOptions is everything needed to write a new deploy config. DetectProject fills in what it can from the
+// project, the rest comes from flags or prompts
+type ScaffoldOptions struct {
+	Name       string
+	Repo       string
+	Builder    string
+	Dockerfile string
+	Args       map[string]interface{}
+	Ports      map[string]int
+	Domain     string
+	DomainPort int
+}
+
+// projectMarkers maps files found in the root of a project to the builder that usually handles them
+var projectMarkers = []struct {
+	File    string
+	Builder string
+}{
+	{File: "go.mod", Builder: "golang"},
+	{File: "package.json", Builder: "node"},
+	{File: "Cargo.toml", Builder: "rust"},
+}
+
+// DetectProject suggests options for a new deploy config from the files in the directory. A Dockerfile is preferred
+// over a builder as the project already knows how to build itself, and only builders named in available are suggested
+// so the config never names a builder that doesn't exist
+func DetectProject(dir string, available []string) ScaffoldOptions {
+	options := ScaffoldOptions{
+		Name: filepath.Base(dir),
+		Repo: GuessRepo(dir),
+		Args: map[string]interface{}{},
+	}
+	if absolute, err := filepath.Abs(dir); err == nil {
+		options.Name = filepath.Base(absolute)
+	}
+
+	if fileExists(filepath.Join(dir, "Dockerfile")) {
+		options.Dockerfile = "Dockerfile"
+		return options
+	}
+
+	for _, marker := range projectMarkers {
+		if fileExists(filepath.Join(dir, marker.File)) && slices.Contains(available, marker.Builder) {
+			options.Builder = marker.Builder
+			break
+		}
+	}
+
+	if options.Builder == "golang" {
+		if entrypoint := guessGoEntrypoint(dir); entrypoint != "" {
+			options.Args["entrypoint"] = entrypoint
+		}
+	}
+
+	return options
+}
+
+// guessGoEntrypoint looks for a main.go in the root of the project, then in each folder under cmd
+func guessGoEntrypoint(dir string) string {
+	if fileExists(filepath.Join(dir, "main.go")) {
+		return "."
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "cmd", "*", "main.go"))
+	slices.Sort(matches)
+	if len(matches) > 0 {
+		return "./cmd/" + filepath.Base(filepath.Dir(matches[0]))
+	}
+	return ""
+}
+
+// GuessRepo returns the owner/name of the repository from the origin remote, or an empty string if there isn't one
+func GuessRepo(dir string) string {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return ""
+	}
+
+	remote, err := repo.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return ""
+	}
+
+	// Handle both http urls and scp style ssh urls like git@gitea:ryan/test-deploy.git
+	raw := remote.Config().URLs[0]
+	repoPath := raw
+	if parsed, err := url.Parse(raw); err == nil && parsed.Scheme != "" {
+		repoPath = parsed.Path
+	} else if _, after, ok := strings.Cut(raw, ":"); ok {
+		repoPath = after
+	}
+
+	return strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+}
+
+func fileExists(file string) bool {
+	stat, err := os.Stat(file)
+	return err == nil && !stat.IsDir()
+}
+
+// RenderDeployConfig writes the options out as a deploy config, leaving out anything that wasn't set
+func RenderDeployConfig(options ScaffoldOptions) (string, error) {
+	var builder strings.Builder
+
+	builder.WriteString("[global]\n")
+	fmt.Fprintf(&builder, "name = %v\n", tomlString(options.Name))
+	fmt.Fprintf(&builder, "repo = %v\n", tomlString(options.Repo))
+
+	// Args can be any JSON value, so the builder table is left to the encoder which handles arrays, nested tables and
+	// escapes
+	section := map[string]interface{}{}
+	if options.Dockerfile != "" {
+		section["dockerfile"] = options.Dockerfile
+	} else {
+		section["id"] = options.Builder
+	}
+	if len(options.Args) > 0 {
+		section["args"] = wholeNumbers(options.Args)
+	}
+
+	builder.WriteString("\n")
+	encoder := toml.NewEncoder(&builder)
+	encoder.Indent = ""
+	if err := encoder.Encode(map[string]interface{}{"builder": section}); err != nil {
+		return "", fmt.Errorf("failed to write the builder section: %w", err)
+	}
+
+	if len(options.Ports) > 0 || options.Domain != "" {
+		builder.WriteString("\n[exec]\n")
+	}
+	if len(options.Ports) > 0 {
+		ports := make([]string, 0, len(options.Ports))
+		for _, port := range sortedKeys(options.Ports) {
+			ports = append(ports, fmt.Sprintf("%v = %v", tomlString(port), options.Ports[port]))
+		}
+		fmt.Fprintf(&builder, "ports = { %v }\n", strings.Join(ports, ", "))
+	}
+	if options.Domain != "" {
+		builder.WriteString("\n[exec.domain]\n")
+		fmt.Fprintf(&builder, "host = %v\n", tomlString(options.Domain))
+		fmt.Fprintf(&builder, "port = %v\n", options.DomainPort)
+	}
+
+	return builder.String(), nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// tomlString quotes a string for the config, escaping it the way TOML expects rather than the way Go does
+func tomlString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&quoted, "\\u%04X", r)
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// wholeNumbers turns whole numbers decoded from JSON, which are always floats, back into integers so they are written
+// as TOML integers
+func wholeNumbers(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case float64:
+		if typed == math.Trunc(typed) && math.Abs(typed) <= 1<<53 {
+			return int64(typed)
+		}
+	case []interface{}:
+		result := make([]interface{}, len(typed))
+		for i, item := range typed {
+			result[i] = wholeNumbers(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[key] = wholeNumbers(item)
+		}
+		return result
+	}
+	return value
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrSuperseded is the cause attached to a build context when a newer push for the same repo and ref arrives
+var ErrSuperseded = errors.New("build was superseded by a newer push")
+
+// ErrCancelled is the cause attached to a build context when it is cancelled through the API
+var ErrCancelled = errors.New("build was cancelled")
+
+// maxFinishedBuilds is how many completed builds (and their logs) are kept in memory for status queries
+const maxFinishedBuilds = 100
+
+type BuildStatus string
+
+const (
+	BuildQueued    BuildStatus = "queued"
+	BuildRunning   BuildStatus = "running"
+	BuildSucceeded BuildStatus = "succeeded"
+	BuildFailed    BuildStatus = "failed"
+	BuildCancelled BuildStatus = "cancelled"
+)
+
+func (status BuildStatus) Finished() bool {
+	return status == BuildSucceeded || status == BuildFailed || status == BuildCancelled
+}
+
+// BuildRecord is the externally visible state of a build that has passed through the webhook server
+type BuildRecord struct {
+	Id       string      `json:"id"`
+	Repo     string      `json:"repo"`
+	Ref      string      `json:"ref,omitempty"`
+	Commit   string      `json:"commit,omitempty"`
+	Status   BuildStatus `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Queued   time.Time   `json:"queued"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+
+	key      string
+	sequence uint64
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	log      *BuildLog
+}
+
+// BuildTracker keeps track of every build queued on the webhook server. It records the latest build for each
+// repo/ref pair so that older builds can be skipped while queued, or cancelled while running, once a newer push
+// arrives
+type BuildTracker struct {
+	lock     sync.Mutex
+	sequence uint64
+	latest   map[string]uint64
+	running  map[string]*BuildRecord
+	builds   map[string]*BuildRecord
+	finished []string
+	watchers map[chan struct{}]struct{}
+}
+
+func NewBuildTracker() *BuildTracker {
+	return &BuildTracker{
+		latest:   map[string]uint64{},
+		running:  map[string]*BuildRecord{},
+		builds:   map[string]*BuildRecord{},
+		watchers: map[chan struct{}]struct{}{},
+	}
+}
+
+func BuildKey(repo string, ref string) string {
+	return repo + "@" + ref
+}
+
+func newBuildId() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Enqueue records a new build for the request, cancelling any in-progress build for the same repo and ref
+func (tracker *BuildTracker) Enqueue(request BuildRequest) BuildRecord {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	key := BuildKey(request.Repository.FullName, request.Ref)
+
+	tracker.sequence++
+	tracker.latest[key] = tracker.sequence
+
+	if running, ok := tracker.running[key]; ok {
+		running.cancel(ErrSuperseded)
+	}
+
+	record := &BuildRecord{
+		Id:       newBuildId(),
+		Repo:     request.Repository.FullName,
+		Ref:      request.Ref,
+		Commit:   request.Commit,
+		Status:   BuildQueued,
+		Queued:   time.Now(),
+		key:      key,
+		sequence: tracker.sequence,
+		log:      NewBuildLog(),
+	}
+	tracker.builds[record.Id] = record
+	tracker.notify()
+
+	return *record
+}
+
+// Start returns a context for the build which will be cancelled if the build is superseded, and the log to which
+// build output should be written. If a newer build has already been queued for the same repo and ref, ok will be
+// false and the build should be skipped. Finish must be called once the build has completed
+func (tracker *BuildTracker) Start(parent context.Context, id string) (ctx context.Context, log *BuildLog, ok bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	record, exists := tracker.builds[id]
+	if !exists {
+		return nil, nil, false
+	}
+
+	if record.Status.Finished() {
+		return nil, nil, false
+	}
+
+	if tracker.latest[record.key] != record.sequence {
+		tracker.finish(record, BuildCancelled, ErrSuperseded)
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	record.ctx, record.cancel = context.WithCancelCause(parent)
+	record.Status = BuildRunning
+	record.Started = &now
+	tracker.running[record.key] = record
+	tracker.notify()
+
+	return record.ctx, record.log, true
+}
+
+// Finish marks the build as complete. Builds which failed because they were superseded or cancelled are recorded as
+// cancelled rather than failed
+func (tracker *BuildTracker) Finish(id string, err error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	record, exists := tracker.builds[id]
+	if !exists || record.Status.Finished() {
+		return
+	}
+
+	if running, ok := tracker.running[record.key]; ok && running == record {
+		delete(tracker.running, record.key)
+	}
+	if tracker.latest[record.key] == record.sequence {
+		delete(tracker.latest, record.key)
+	}
+
+	status := BuildSucceeded
+	if err != nil {
+		status = BuildFailed
+		if cause := context.Cause(record.ctx); errors.Is(cause, ErrSuperseded) || errors.Is(cause, ErrCancelled) {
+			status = BuildCancelled
+			err = cause
+		}
+	}
+
+	record.cancel(nil)
+	tracker.finish(record, status, err)
+}
+
+func (tracker *BuildTracker) finish(record *BuildRecord, status BuildStatus, err error) {
+	now := time.Now()
+	record.Status = status
+	record.Finished = &now
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.log.Close()
+
+	tracker.finished = append(tracker.finished, record.Id)
+	if len(tracker.finished) > maxFinishedBuilds {
+		delete(tracker.builds, tracker.finished[0])
+		tracker.finished = slices.Delete(tracker.finished, 0, 1)
+	}
+	tracker.notify()
+}
+
+// notify wakes up every watcher without blocking, watchers only need to know that something changed
+func (tracker *BuildTracker) notify() {
+	for watcher := range tracker.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watch returns a channel which receives a value whenever a build changes state, and a function to stop watching
+func (tracker *BuildTracker) Watch() (<-chan struct{}, func()) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	watcher := make(chan struct{}, 1)
+	tracker.watchers[watcher] = struct{}{}
+
+	return watcher, func() {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		delete(tracker.watchers, watcher)
+	}
+}
+
+// Get returns a copy of the record for the build alongside its log
+func (tracker *BuildTracker) Get(id string) (BuildRecord, *BuildLog, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	record, ok := tracker.builds[id]
+	if !ok {
+		return BuildRecord{}, nil, false
+	}
+
+	return *record, record.log, true
+}
+
+// Cancel stops a queued or running build, returning false if the build does not exist or has already finished
+func (tracker *BuildTracker) Cancel(id string) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	record, ok := tracker.builds[id]
+	if !ok || record.Status.Finished() {
+		return false
+	}
+
+	if record.Status == BuildRunning {
+		record.cancel(ErrCancelled)
+		return true
+	}
+
+	if tracker.latest[record.key] == record.sequence {
+		delete(tracker.latest, record.key)
+	}
+	tracker.finish(record, BuildCancelled, ErrCancelled)
+	return true
+}
+
+// List returns a copy of every build the tracker knows about, oldest first
+func (tracker *BuildTracker) List() []BuildRecord {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	result := make([]BuildRecord, 0, len(tracker.builds))
+	for _, record := range tracker.builds {
+		result = append(result, *record)
+	}
+
+	slices.SortFunc(result, func(a, b BuildRecord) int {
+		return a.Queued.Compare(b.Queued)
+	})
+	return result
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TriggerRequest is the body accepted by POST /api/builds. CloneUrl can only be set by admin tokens, and is only
+// required if the webhook server was not launched with a git base url. IgnoreWindow skips the deploy window
+type TriggerRequest struct {
+	Repo         string                 `json:"repo"`
+	CloneUrl     string                 `json:"clone_url,omitempty"`
+	Ref          string                 `json:"ref,omitempty"`
+	Commit       string                 `json:"commit,omitempty"`
+	Args         map[string]interface{} `json:"args,omitempty"`
+	IgnoreWindow bool                   `json:"ignore_window,omitempty"`
+}
+
+// RegisterTriggerHandlers adds the endpoints to trigger, inspect and follow builds. Triggered refs must be allowed by
+// the same allowed refs as webhooks
+func RegisterTriggerHandlers(mux *http.ServeMux, configuration WebhookConfiguration, allowedRefs map[string][]string, channel chan QueuedBuild) {
+	mux.HandleFunc("POST /api/builds", RequireRole(configuration.Etcd, RoleDeployer, func(writer http.ResponseWriter, request *http.Request) {
+		var trigger TriggerRequest
+		err := json.NewDecoder(request.Body).Decode(&trigger)
+		if err != nil {
+			slog.Error("failed to unmarshall trigger body", "err", err)
+			http.Error(writer, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if trigger.Repo == "" {
+			http.Error(writer, "repo is required", http.StatusBadRequest)
+			return
+		}
+
+		if !TokenFromContext(request.Context()).CanAccess(trigger.Repo) {
+			http.Error(writer, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		// The clone url decides what is built, so only admins may point a build somewhere other than the repo's own url
+		cloneUrl := trigger.CloneUrl
+		if cloneUrl != "" && !TokenFromContext(request.Context()).Role.Allows(RoleAdmin) {
+			http.Error(writer, "clone_url can only be set by admin tokens", http.StatusForbidden)
+			return
+		}
+		if cloneUrl == "" {
+			if configuration.GitBaseUrl == nil {
+				http.Error(writer, "clone_url is required as no git base url is configured", http.StatusBadRequest)
+				return
+			}
+			cloneUrl = strings.TrimSuffix(*configuration.GitBaseUrl, "/") + "/" + trigger.Repo + ".git"
+		}
+
+		// The default branch is resolved up front so it is checked against the allowed refs, and so the build
+		// supersedes and is superseded by pushes to the same branch
+		ref := trigger.Ref
+		if ref == "" {
+			ref, err = resolveDefaultRef(request.Context(), cloneUrl)
+			if err != nil {
+				slog.Error("failed to resolve default branch", "repo", trigger.Repo, "err", err)
+				http.Error(writer, "failed to resolve the default branch, pass a ref", http.StatusBadGateway)
+				return
+			}
+		}
+
+		if !RefAllowed(allowedRefs, trigger.Repo, ref) {
+			http.Error(writer, "ref is not allowed", http.StatusForbidden)
+			return
+		}
+
+		record := Enqueue(channel, configuration.Tracker, BuildRequest{
+			Repository:   Repository{CloneUrl: cloneUrl, FullName: trigger.Repo},
+			Ref:          ref,
+			Commit:       trigger.Commit,
+			Args:         trigger.Args,
+			IgnoreWindow: trigger.IgnoreWindow,
+		})
+		slog.Info("manually triggered build", "id", record.Id, "repo", record.Repo, "ref", record.Ref, "commit", record.Commit)
+
+		writeJson(writer, http.StatusAccepted, record)
+	}))
+
+	mux.HandleFunc("GET /api/builds/{id}", RequireRole(configuration.Etcd, RoleViewer, func(writer http.ResponseWriter, request *http.Request) {
+		record, _, ok := configuration.Tracker.Get(request.PathValue("id"))
+		if !ok || !TokenFromContext(request.Context()).CanAccess(record.Repo) {
+			http.Error(writer, "build not found", http.StatusNotFound)
+			return
+		}
+
+		writeJson(writer, http.StatusOK, record)
+	}))
+
+	mux.HandleFunc("GET /api/builds/{id}/log", RequireRole(configuration.Etcd, RoleViewer, func(writer http.ResponseWriter, request *http.Request) {
+		record, buildLog, ok := configuration.Tracker.Get(request.PathValue("id"))
+		if !ok || !TokenFromContext(request.Context()).CanAccess(record.Repo) {
+			http.Error(writer, "build not found", http.StatusNotFound)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+
+		flusher, _ := writer.(http.Flusher)
+		err := buildLog.Follow(request.Context(), writer, func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("failed to stream build log", "err", err)
+		}
+	}))
+}
+
+// resolveDefaultRef asks the remote which branch its HEAD points at
+func resolveDefaultRef(ctx context.Context, cloneUrl string) (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{cloneUrl}})
+
+	listCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	refs, err := remote.ListContext(listCtx, &git.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote refs: %w", err)
+	}
+
+	var head *plumbing.Reference
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+		}
+	}
+	if head == nil {
+		return "", errors.New("remote has no HEAD")
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		return head.Target().String(), nil
+	}
+
+	// Servers that don't advertise where HEAD points are matched up by commit instead
+	for _, ref := range refs {
+		if ref.Name().IsBranch() && ref.Hash() == head.Hash() {
+			return ref.Name().String(), nil
+		}
+	}
+	return "", errors.New("could not find the branch HEAD points at")
+}
+
+func writeJson(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		slog.Error("failed to write response", "err", err)
+	}
+}
+
+// TriggerClient talks to the build endpoints of a remote webhook server
+type TriggerClient struct {
+	Server string
+	Token  string
+	Client *http.Client
+}
+
+func (client TriggerClient) do(ctx context.Context, method string, endpoint string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialise request: %w", err)
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	target, err := url.JoinPath(client.Server, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+client.Token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("server responded with %v: %v", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	return response, nil
+}
+
+func (client TriggerClient) decode(ctx context.Context, method string, endpoint string, body any) (*BuildRecord, error) {
+	response, err := client.do(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var record BuildRecord
+	err = json.NewDecoder(response.Body).Decode(&record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &record, nil
+}
+
+func (client TriggerClient) Trigger(ctx context.Context, trigger TriggerRequest) (*BuildRecord, error) {
+	return client.decode(ctx, http.MethodPost, "api/builds", trigger)
+}
+
+func (client TriggerClient) Get(ctx context.Context, id string) (*BuildRecord, error) {
+	return client.decode(ctx, http.MethodGet, "api/builds/"+url.PathEscape(id), nil)
+}
+
+// Follow copies the log of the build to the writer until the build completes
+func (client TriggerClient) Follow(ctx context.Context, id string, writer io.Writer) error {
+	response, err := client.do(ctx, http.MethodGet, "api/builds/"+url.PathEscape(id)+"/log", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	_, err = io.Copy(writer, response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read build log: %w", err)
+	}
+
+	return nil
+}
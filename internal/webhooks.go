@@ -1,15 +1,23 @@
 package internal
 
 import (
+	"context"
+	"echo-cicd/configs"
 	"encoding/json"
+	"errors"
+	"fmt"
 	docker "github.com/docker/docker/client"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"path"
 	"slices"
+	"strings"
+	"time"
 )
 
 type Repository struct {
@@ -17,25 +25,67 @@ type Repository struct {
 	FullName string `json:"full_name"`
 }
 
+// PushPayload is the body of push, delete and repository events. Delete events carry the short name of the ref and its
+// type, and repository events carry the action that was taken on the repository
 type PushPayload struct {
 	Repository Repository `json:"repository"`
 	Ref        string     `json:"ref"`
+	RefType    string     `json:"ref_type"`
+	After      string     `json:"after"`
+	Deleted    bool       `json:"deleted"`
+	Action     string     `json:"action"`
+}
+
+// Commit returns the commit the push moved the ref to, or an empty string if the payload did not include one
+func (payload PushPayload) Commit() string {
+	if strings.Trim(payload.After, "0") == "" {
+		return ""
+	}
+	return payload.After
+}
+
+// BuildRequest describes a single build, either from a push webhook or triggered manually. Commit and Args are
+// optional, if no commit is specified the head of the ref is built. IgnoreWindow deploys the build outside of its
+// deploy window
+type BuildRequest struct {
+	Repository   Repository
+	Ref          string
+	Commit       string
+	Args         map[string]interface{}
+	IgnoreWindow bool
+}
+
+// QueuedBuild is a build request waiting for the processor, identified by the id the BuildTracker assigned to it
+type QueuedBuild struct {
+	Request BuildRequest
+	Id      string
 }
 
 type WebhookConfiguration struct {
 	BuildersDir string
-	Conn        *docker.Client
-	Registry    *string
-	PushAuth    *string
-	Bind        string
-	Etcd        *EtcdClient
+	// Builders is set when builders are fetched from git, in which case it takes the place of BuildersDir
+	Builders   *BuilderRepository
+	Conn       *docker.Client
+	Registry   *string
+	Auths      *RegistryAuths
+	Bind       string
+	Etcd       *EtcdClient
+	Tracker    *BuildTracker
+	GitBaseUrl *string
 }
 
-func ProcessEvent(event PushPayload, configuration WebhookConfiguration) {
+// AcquireBuildersDir returns the folder builds should load builders from, which is kept until release is called
+func (configuration WebhookConfiguration) AcquireBuildersDir() (dir string, release func()) {
+	if configuration.Builders != nil {
+		return configuration.Builders.Acquire()
+	}
+	return configuration.BuildersDir, func() {}
+}
+
+func ProcessEvent(ctx context.Context, request BuildRequest, configuration WebhookConfiguration, output io.Writer) error {
 	temp, err := os.MkdirTemp("", "echocicd-")
 	if err != nil {
-		slog.Error("could not create temp dir to clone into", "err", err)
-		return
+		return fmt.Errorf("could not create temp dir to clone into: %w", err)
 	}
 
 	defer func(path string) {
@@ -45,59 +95,251 @@ func ProcessEvent(event PushPayload, configuration WebhookConfiguration) {
 		}
 	}(temp)
 
-	_, err = git.PlainClone(temp, false, &git.CloneOptions{
-		URL:      event.Repository.CloneUrl,
-		Progress: os.Stdout,
-	})
+	cloneCtx, cancel := context.WithTimeout(ctx, DefaultBuildTimeout)
+	defer cancel()
+
+	cloneOptions := &git.CloneOptions{
+		URL:      request.Repository.CloneUrl,
+		Progress: output,
+	}
+	if strings.HasPrefix(request.Ref, "refs/") {
+		cloneOptions.ReferenceName = plumbing.ReferenceName(request.Ref)
+	}
+
+	repo, err := git.PlainCloneContext(cloneCtx, temp, false, cloneOptions)
 	if err != nil {
-		slog.Error("failed to clone project", "err", err)
-		return
+		return fmt.Errorf("failed to clone project: %w", err)
+	}
+
+	if request.Commit != "" {
+		hash, err := repo.ResolveRevision(plumbing.Revision(request.Commit))
+		if err != nil {
+			return fmt.Errorf("could not find commit %v: %w", request.Commit, err)
+		}
+
+		worktree, err := repo.Worktree()
+		if err != nil {
+			return fmt.Errorf("could not open worktree: %w", err)
+		}
+
+		err = worktree.Checkout(&git.CheckoutOptions{Hash: *hash})
+		if err != nil {
+			return fmt.Errorf("could not checkout commit %v: %w", request.Commit, err)
+		}
 	}
 
 	stat, err := os.Stat(path.Join(temp, ".deploy-config.toml"))
 	if err != nil {
-		slog.Error("could not find deploy config in this project", "err", err)
-		return
+		return fmt.Errorf("could not find deploy config in this project: %w", err)
 	}
 
 	if stat.IsDir() {
-		slog.Error("deploy config was not a file", "stat", stat)
-		return
-	}
-
-	err = BuildInDir(
-		temp,
-		".deploy-config.toml",
-		configuration.BuildersDir,
-		configuration.Conn,
-		configuration.Registry,
-		configuration.PushAuth,
-		configuration.Etcd,
-	)
+		return errors.New("deploy config was not a file")
+	}
+
+	config, err := configs.LoadDeployConfigFromFile(path.Join(temp, ".deploy-config.toml"))
 	if err != nil {
-		slog.Error("failed to build!", "err", err)
-		return
+		return err
 	}
 
-	slog.Info("successfully built and maybe pushed!", "ref", event.Ref, "repo", event.Repository)
+	// Manual builds without a ref build the default branch, which is what environments need to match against
+	ref := request.Ref
+	if ref == "" {
+		if head, err := repo.Head(); err == nil {
+			ref = head.Name().String()
+		}
+	}
+
+	builds, err := config.ForRef(ref)
+	if err != nil {
+		return err
+	}
+
+	// Builds are published under the repo named in the deploy config, which must be the repo that was cloned so one
+	// repo can never replace the deployments of another. Repository names are not case sensitive, so builds are
+	// published under the name the repository was cloned as
+	for i, build := range builds {
+		if !strings.EqualFold(build.Global.Repo, request.Repository.FullName) {
+			return fmt.Errorf("deploy config is for %v but was cloned from %v", build.Global.Repo, request.Repository.FullName)
+		}
+		builds[i].Global.Repo = request.Repository.FullName
+	}
+
+	// Every environment is built with the same builders, which are kept until the last build finishes
+	buildersDir, release := configuration.AcquireBuildersDir()
+	defer release()
+
+	for _, build := range builds {
+		build.Ref = ref
+		build.IgnoreWindow = request.IgnoreWindow
+		if len(request.Args) > 0 {
+			build.Builder.Args = maps.Clone(build.Builder.Args)
+			if build.Builder.Args == nil {
+				build.Builder.Args = map[string]interface{}{}
+			}
+			maps.Copy(build.Builder.Args, request.Args)
+		}
+
+		// Undeployed projects stay stopped until they are restored, so there is no point building them
+		key := DeploymentKey(build.Global.Repo, build.Environment)
+		stopped, err := configuration.Etcd.IsStopped(ctx, key)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			slog.Info("skipping build of undeployed project", "key", key)
+			_, _ = fmt.Fprintf(output, "skipping %v as it has been undeployed, run echocicd restore to deploy it again\n", key)
+			continue
+		}
+
+		if build.Environment != "" {
+			slog.Info("building environment", "environment", build.Environment, "name", build.Global.Name, "ref", ref)
+			_, _ = fmt.Fprintf(output, "building environment %v as %v\n", build.Environment, build.Global.Name)
+		}
+
+		err = BuildFromConfig(
+			ctx,
+			build,
+			buildersDir,
+			temp,
+			configuration.Conn,
+			configuration.Registry,
+			configuration.Auths,
+			configuration.Etcd,
+			output,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to build: %w", err)
+		}
+
+		if build.Exec.Approval == configs.ApprovalManual {
+			command := "echocicd approve " + build.Global.Repo
+			if build.Environment != "" {
+				command += " --env " + build.Environment
+			}
+			_, _ = fmt.Fprintf(output, "build is waiting for approval, run %v\n", command)
+		}
+
+		if build.PreviewRef != "" {
+			err = configuration.Etcd.TouchPreview(ctx, PreviewRecord{
+				Key:  DeploymentKey(build.Global.Repo, build.Environment),
+				Repo: request.Repository.FullName,
+				Ref:  build.PreviewRef,
+				Name: build.Global.Name,
+				Ttl:  build.Preview.EffectiveTtl().Milliseconds(),
+			})
+			if err != nil {
+				return err
+			}
+			if build.Exec.Domain != nil {
+				_, _ = fmt.Fprintf(output, "preview published for %v\n", build.Exec.Domain.Host)
+			}
+		}
+	}
+
+	slog.Info("successfully built and maybe pushed!", "ref", request.Ref, "repo", request.Repository)
+	return nil
 }
 
-func LaunchProcessor(events chan PushPayload, configuration WebhookConfiguration) {
+func LaunchProcessor(events chan QueuedBuild, configuration WebhookConfiguration) {
 	for {
-		event := <-events
-		ProcessEvent(event, configuration)
+		queued := <-events
+
+		ctx, buildLog, ok := configuration.Tracker.Start(context.Background(), queued.Id)
+		if !ok {
+			slog.Info("skipping build as a newer push has been queued", "id", queued.Id, "ref", queued.Request.Ref, "repo", queued.Request.Repository.FullName)
+			continue
+		}
+
+		slog.Info("starting build", "id", queued.Id, "ref", queued.Request.Ref, "repo", queued.Request.Repository.FullName)
+		err := ProcessEvent(ctx, queued.Request, configuration, buildLog)
+		if err != nil {
+			if cause := context.Cause(ctx); errors.Is(cause, ErrSuperseded) || errors.Is(cause, ErrCancelled) {
+				slog.Info("build cancelled", "cause", cause, "id", queued.Id, "ref", queued.Request.Ref, "repo", queued.Request.Repository.FullName)
+			} else {
+				slog.Error("failed to build!", "id", queued.Id, "err", err)
+				_, _ = fmt.Fprintf(buildLog, "build failed: %v\n", err)
+			}
+		}
+
+		configuration.Tracker.Finish(queued.Id, err)
+	}
+}
+
+// handleDeletedRef retires everything built from a deleted branch, including its previews, returning the status to
+// respond with
+func handleDeletedRef(ctx context.Context, configuration WebhookConfiguration, payload PushPayload) int {
+	repo, ref := payload.Repository.FullName, payload.Ref
+	slog.Info("branch was deleted, retiring its builds", "repo", repo, "ref", ref)
+
+	err := errors.Join(
+		configuration.Etcd.TeardownPreviewsForRef(ctx, repo, ref),
+		configuration.Etcd.RetireBuildsForRef(ctx, repo, ref),
+	)
+	if err != nil {
+		slog.Error("failed to retire builds for deleted branch", "repo", repo, "ref", ref, "err", err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// handleRepositoryEvent retires every build of a repository that has been deleted or archived, returning the status
+// to respond with
+func handleRepositoryEvent(ctx context.Context, configuration WebhookConfiguration, allowedRefs map[string][]string, payload PushPayload) int {
+	repo := payload.Repository.FullName
+	if payload.Action != "deleted" && payload.Action != "archived" {
+		slog.Info("ignoring repository event", "repo", repo, "action", payload.Action)
+		return http.StatusOK
+	}
+
+	_, okRepo := allowedRefs[repo]
+	_, okAll := allowedRefs["*"]
+	if !okRepo && !okAll {
+		slog.Error("repository was not allowlisted", "repo", repo)
+		return http.StatusForbidden
+	}
+
+	slog.Info("repository was removed, retiring its builds", "repo", repo, "action", payload.Action)
+	if err := configuration.Etcd.RetireRepository(ctx, repo); err != nil {
+		slog.Error("failed to retire builds for repository", "repo", repo, "err", err)
+		return http.StatusInternalServerError
 	}
+	return http.StatusOK
 }
 
+// RefAllowed checks the ref against the allowed refs for the repo and for every repo (*). Entries are globs matched
+// with path.Match, so refs/heads/feature/* allows every feature branch
+func RefAllowed(allowedRefs map[string][]string, repo string, ref string) bool {
+	matches := func(pattern string) bool {
+		matched, err := path.Match(pattern, ref)
+		return err == nil && matched
+	}
+	return slices.ContainsFunc(allowedRefs[repo], matches) || slices.ContainsFunc(allowedRefs["*"], matches)
+}
+
+// Enqueue registers the request with the tracker and hands it to the processor
+func Enqueue(channel chan QueuedBuild, tracker *BuildTracker, request BuildRequest) BuildRecord {
+	record := tracker.Enqueue(request)
+	channel <- QueuedBuild{Request: request, Id: record.Id}
+	return record
+}
+
+// previewReapInterval is how often previews are checked against their ttl
+const previewReapInterval = 5 * time.Minute
+
 func LaunchWebhookServer(configuration WebhookConfiguration, allowedRefs map[string][]string) {
-	channel := make(chan PushPayload, 100)
+	channel := make(chan QueuedBuild, 100)
+	if configuration.Tracker == nil {
+		configuration.Tracker = NewBuildTracker()
+	}
 
-	http.HandleFunc("/hook", func(writer http.ResponseWriter, request *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hook", func(writer http.ResponseWriter, request *http.Request) {
 		slog.Info("got request", "request", request)
 		defer func(Body io.ReadCloser) {
 			err := Body.Close()
 			if err != nil {
-				slog.Error("could not close request body", "err, err")
+				slog.Error("could not close request body", "err", err)
 			}
 		}(request.Body)
 
@@ -116,6 +358,13 @@ func LaunchWebhookServer(configuration WebhookConfiguration, allowedRefs map[str
 
 		slog.Info("got payload", "payload", body)
 
+		githubEvent := request.Header.Get("X-GitHub-Event")
+		if !slices.Contains([]string{"push", "delete", "repository"}, githubEvent) {
+			slog.Error("didn't get a push, delete or repository event", "event", githubEvent)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
 		var payloadBody PushPayload
 		err = json.Unmarshal(body, &payloadBody)
 		if err != nil {
@@ -124,33 +373,60 @@ func LaunchWebhookServer(configuration WebhookConfiguration, allowedRefs map[str
 			return
 		}
 
-		repoValidRefs, okRepo := allowedRefs[payloadBody.Repository.FullName]
-		allValidRefs, okAll := allowedRefs["*"]
-		if !okRepo && !okAll {
-			slog.Error("ref was not allowlisted anywhere")
-			writer.WriteHeader(http.StatusForbidden)
+		if githubEvent == "repository" {
+			writer.WriteHeader(handleRepositoryEvent(request.Context(), configuration, allowedRefs, payloadBody))
+			return
+		}
+
+		// Delete events name the branch without the refs/heads/ prefix
+		if githubEvent == "delete" {
+			if payloadBody.RefType != "branch" {
+				slog.Info("ignoring deletion of something other than a branch", "type", payloadBody.RefType)
+				writer.WriteHeader(http.StatusOK)
+				return
+			}
+			payloadBody.Ref = "refs/heads/" + strings.TrimPrefix(payloadBody.Ref, "refs/heads/")
+		}
+
+		// Pushes to the builder repository refresh the builders rather than starting a build
+		if githubEvent == "push" && configuration.Builders != nil && configuration.Builders.Matches(payloadBody.Repository) {
+			slog.Info("builder repository was pushed to, refreshing builders", "repo", payloadBody.Repository.FullName)
+			go func() {
+				if err := configuration.Builders.Refresh(context.Background()); err != nil {
+					slog.Error("failed to refresh builders", "err", err)
+				}
+			}()
+			writer.WriteHeader(http.StatusAccepted)
 			return
 		}
 
-		if !slices.Contains(repoValidRefs, payloadBody.Ref) && !slices.Contains(allValidRefs, payloadBody.Ref) {
-			slog.Error("ref was not allowlisted", "repo-valid", repoValidRefs, "all-valid", allValidRefs)
+		if !RefAllowed(allowedRefs, payloadBody.Repository.FullName, payloadBody.Ref) {
+			slog.Error("ref was not allowlisted", "repo", payloadBody.Repository.FullName, "ref", payloadBody.Ref)
 			writer.WriteHeader(http.StatusForbidden)
 			return
 		}
 
-		githubEvent := request.Header.Get("X-GitHub-Event")
-		if githubEvent != "push" {
-			slog.Error("didn't get a push event", "event", githubEvent)
-			writer.WriteHeader(http.StatusBadRequest)
+		// Deleting a branch also sends a push event moving it to the zero commit, which is handled the same way
+		if githubEvent == "delete" || payloadBody.Deleted {
+			writer.WriteHeader(handleDeletedRef(request.Context(), configuration, payloadBody))
 			return
 		}
 
-		channel <- payloadBody
+		Enqueue(channel, configuration.Tracker, BuildRequest{
+			Repository: payloadBody.Repository,
+			Ref:        payloadBody.Ref,
+			Commit:     payloadBody.Commit(),
+		})
 		writer.WriteHeader(http.StatusOK)
 	})
 
+	RegisterTriggerHandlers(mux, configuration, allowedRefs, channel)
+	RegisterApiHandlers(mux, configuration)
+	RegisterDashboardHandlers(mux, configuration)
+
 	go LaunchProcessor(channel, configuration)
-	err := http.ListenAndServe(configuration.Bind, nil)
+	go LaunchPreviewReaper(context.Background(), configuration.Etcd, previewReapInterval)
+	err := http.ListenAndServe(configuration.Bind, mux)
 	if err != nil {
 		slog.Error("failed to launch the server", "err", err)
 	}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// Retry calls operation until it succeeds, it returns an error for which retryable is false, or attempts run out. The
+// delay between attempts starts at initial and doubles each time up to maxDelay
+func Retry(ctx context.Context, attempts int, initial time.Duration, maxDelay time.Duration, retryable func(error) bool, operation func() error) error {
+	delay := initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, maxDelay)
+	}
+}